@@ -0,0 +1,239 @@
+package alert
+
+// Evaluates the configured AlertRules against each fresh BackupStatus, keeping track of
+// which alerts are active so that only changes (newly firing or resolved) are reported.
+
+import (
+	"fmt"
+	"log"
+	"reporter/config"
+	"reporter/status"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var severityRank = map[string]int{
+	config.SEVERITY_INFO:     1,
+	config.SEVERITY_WARNING:  2,
+	config.SEVERITY_CRITICAL: 3,
+}
+
+// An alert raised by a rule, for one source.
+type Alert struct {
+	Rule     string
+	Severity string
+	Source   string
+	Message  string // eg "MissingFiles 12 > 5"
+	Since    string // When the alert first fired
+}
+
+var active = map[string]Alert{} // Keyed by rule name and source
+var mutex = &sync.Mutex{}
+
+// Evaluates the rules against each status. Returns the alerts that have fired and those that have
+// resolved since the previous Check, plus all that are now active (including those just fired).
+// A rule whose metric cannot be determined (eg syncthing could not be reached) leaves its alert
+// unchanged. Invalid rules are logged and skipped.
+func Check(rules []config.AlertRule, statuses []status.BackupStatus) (fired, resolved, current []Alert) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return check(rules, statuses, active)
+}
+
+// Returns what Check would, but without changing the active alerts (for a preview).
+func Preview(rules []config.AlertRule, statuses []status.BackupStatus) (fired, resolved, current []Alert) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	copied := map[string]Alert{}
+	for key, a := range active {
+		copied[key] = a
+	}
+	return check(rules, statuses, copied)
+}
+
+// Evaluates the rules, updating the active alerts.
+func check(rules []config.AlertRule, statuses []status.BackupStatus, active map[string]Alert) (fired, resolved, current []Alert) {
+	now := time.Now().Format(config.TIME_FORMAT)
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if err := config.CheckAlertRule(rule); err != nil {
+			log.Printf("ERROR: alert rule %s: %s\n", rule.Name, err)
+			continue
+		}
+		for _, s := range statuses {
+			key := rule.Name + "/" + s.Source
+			seen[key] = true
+			firing, message, known := evaluate(rule, s)
+			if !known {
+				continue
+			}
+			previous, wasActive := active[key]
+			if firing && !wasActive {
+				a := Alert{Rule: rule.Name, Severity: rule.Severity, Source: s.Source, Message: message, Since: now}
+				active[key] = a
+				fired = append(fired, a)
+			} else if firing {
+				previous.Message = message // Keep the latest value
+				active[key] = previous
+			} else if wasActive {
+				delete(active, key)
+				previous.Message = message
+				resolved = append(resolved, previous)
+			}
+		}
+	}
+	// Alerts for rules or sources that are no longer configured are dropped.
+	for key := range active {
+		if !seen[key] {
+			delete(active, key)
+		}
+	}
+	return fired, resolved, sorted(active)
+}
+
+// Returns the alerts that are currently active, without re-evaluating.
+func Active() []Alert {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return sorted(active)
+}
+
+// Returns the alerts ordered by source then rule.
+func sorted(alerts map[string]Alert) []Alert {
+	var list []Alert
+	for _, a := range alerts {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Source != list[j].Source {
+			return list[i].Source < list[j].Source
+		}
+		return list[i].Rule < list[j].Rule
+	})
+	return list
+}
+
+// Returns the highest severity of the alerts.
+func HighestSeverity(alerts []Alert) string {
+	highest := ""
+	for _, a := range alerts {
+		if severityRank[a.Severity] > severityRank[highest] {
+			highest = a.Severity
+		}
+	}
+	return highest
+}
+
+// Returns whether the rule fires for the status, with a message describing the value tested.
+// Returns known=false if the metric's value is not available.
+func evaluate(rule config.AlertRule, s status.BackupStatus) (firing bool, message string, known bool) {
+	var compared int
+	var value string
+	switch config.AlertMetrics[rule.Metric] {
+	case config.METRIC_STRING:
+		v, ok := stringMetric(rule.Metric, s)
+		if !ok {
+			return false, "", false
+		}
+		value = v
+		compared = strings.Compare(v, rule.Value)
+	case config.METRIC_DURATION:
+		if s.Error != "" || s.SourceAge == "" {
+			return false, "", false
+		}
+		age, err := config.ParseAge(s.SourceAge)
+		if err != nil {
+			return false, "", false
+		}
+		threshold, _ := config.ParseAge(rule.Value)
+		value = s.SourceAge
+		compared = compare(int64(age), int64(threshold))
+	default:
+		v, ok := numberMetric(rule.Metric, s)
+		if !ok {
+			return false, "", false
+		}
+		threshold, _ := strconv.ParseInt(rule.Value, 10, 64)
+		value = strconv.FormatInt(v, 10)
+		compared = compare(v, threshold)
+	}
+	switch rule.Op {
+	case "==":
+		firing = compared == 0
+	case "!=":
+		firing = compared != 0
+	case ">":
+		firing = compared > 0
+	case ">=":
+		firing = compared >= 0
+	case "<":
+		firing = compared < 0
+	case "<=":
+		firing = compared <= 0
+	}
+	message = fmt.Sprintf("%s %s %s %s", rule.Metric, quote(value), rule.Op, quote(rule.Value))
+	return firing, message, true
+}
+
+func compare(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func quote(value string) string {
+	if value == "" {
+		return `""`
+	}
+	return value
+}
+
+func stringMetric(metric string, s status.BackupStatus) (string, bool) {
+	switch metric {
+	case "Error":
+		return s.Error, true
+	case "State":
+		if s.Syncthing == nil {
+			return "", false
+		}
+		return s.Syncthing.State, true
+	}
+	return "", false
+}
+
+func numberMetric(metric string, s status.BackupStatus) (int64, bool) {
+	if s.Syncthing != nil {
+		switch metric {
+		case "PullErrors":
+			return int64(s.Syncthing.PullErrors), true
+		case "NeedFiles":
+			return int64(s.Syncthing.NeedFiles), true
+		case "NeedBytes":
+			return s.Syncthing.NeedBytes, true
+		}
+	}
+	if s.Error != "" {
+		return 0, false // The counts are not reliable
+	}
+	switch metric {
+	case "MissingFiles":
+		return int64(s.MissingFiles), true
+	case "MissingBytes":
+		return s.MissingBytes, true
+	case "BackedUpFiles":
+		return int64(s.BackedUpFiles), true
+	case "BackedUpBytes":
+		return s.BackedUpBytes, true
+	case "SourceFiles":
+		return int64(s.SourceFiles), true
+	case "SourceBytes":
+		return s.SourceBytes, true
+	}
+	return 0, false
+}
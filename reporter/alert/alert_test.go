@@ -0,0 +1,90 @@
+package alert
+
+import (
+	"reporter/config"
+	"reporter/status"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	idle := &status.SyncthingStatus{State: "idle", PullErrors: 2}
+	tests := []struct {
+		rule    config.AlertRule
+		status  status.BackupStatus
+		known   bool
+		firing  bool
+		message string
+	}{
+		{config.AlertRule{Metric: "MissingFiles", Op: ">", Value: "10"}, status.BackupStatus{MissingFiles: 12}, true, true, "MissingFiles 12 > 10"},
+		{config.AlertRule{Metric: "MissingFiles", Op: ">", Value: "10"}, status.BackupStatus{MissingFiles: 10}, true, false, "MissingFiles 10 > 10"},
+		{config.AlertRule{Metric: "MissingFiles", Op: ">=", Value: "10"}, status.BackupStatus{MissingFiles: 10}, true, true, "MissingFiles 10 >= 10"},
+		{config.AlertRule{Metric: "MissingBytes", Op: "<", Value: "0"}, status.BackupStatus{MissingBytes: -5}, true, true, "MissingBytes -5 < 0"},
+		{config.AlertRule{Metric: "SourceFiles", Op: "==", Value: "0"}, status.BackupStatus{SourceFiles: 3}, true, false, "SourceFiles 3 == 0"},
+		// The counts aren't known when the status failed, but syncthing's may be
+		{config.AlertRule{Metric: "MissingFiles", Op: ">", Value: "10"}, status.BackupStatus{Error: "unreachable"}, false, false, ""},
+		{config.AlertRule{Metric: "PullErrors", Op: ">", Value: "0"}, status.BackupStatus{Error: "no file", Syncthing: idle}, true, true, "PullErrors 2 > 0"},
+		{config.AlertRule{Metric: "PullErrors", Op: ">", Value: "0"}, status.BackupStatus{}, false, false, ""},
+		// Ages, with days and weeks
+		{config.AlertRule{Metric: "SourceAge", Op: ">", Value: "2d"}, status.BackupStatus{SourceAge: "49h0m"}, true, true, "SourceAge 49h0m > 2d"},
+		{config.AlertRule{Metric: "SourceAge", Op: ">", Value: "1w"}, status.BackupStatus{SourceAge: "49h0m"}, true, false, "SourceAge 49h0m > 1w"},
+		{config.AlertRule{Metric: "SourceAge", Op: ">", Value: "2d"}, status.BackupStatus{}, false, false, ""},
+		// Text
+		{config.AlertRule{Metric: "State", Op: "!=", Value: "idle"}, status.BackupStatus{Syncthing: idle}, true, false, "State idle != idle"},
+		{config.AlertRule{Metric: "State", Op: "==", Value: "idle"}, status.BackupStatus{}, false, false, ""},
+		{config.AlertRule{Metric: "Error", Op: "!=", Value: ""}, status.BackupStatus{}, true, false, `Error "" != ""`},
+		{config.AlertRule{Metric: "Error", Op: "!=", Value: ""}, status.BackupStatus{Error: "gone"}, true, true, `Error gone != ""`},
+	}
+	for _, test := range tests {
+		firing, message, known := evaluate(test.rule, test.status)
+		if known != test.known || firing != test.firing || message != test.message {
+			t.Errorf("%+v on %+v: got %v, %v, %q; expected %v, %v, %q", test.rule, test.status,
+				known, firing, message, test.known, test.firing, test.message)
+		}
+	}
+}
+
+// An alert fires once, stays active while it fires or is unknown, and then resolves.
+func TestCheck(t *testing.T) {
+	rules := []config.AlertRule{
+		{Name: "missing", Metric: "MissingFiles", Op: ">", Value: "10", Severity: config.SEVERITY_WARNING},
+		{Name: "bad", Metric: "Missing", Op: ">", Value: "10", Severity: config.SEVERITY_WARNING}, // Skipped
+	}
+	tests := []struct {
+		missing  int32
+		error    string
+		fired    int
+		resolved int
+		current  int
+	}{
+		{5, "", 0, 0, 0},
+		{12, "", 1, 0, 1},
+		{15, "", 0, 0, 1},
+		{0, "unreachable", 0, 0, 1},
+		{3, "", 0, 1, 0},
+		{3, "", 0, 0, 0},
+	}
+	active := map[string]Alert{}
+	for i, test := range tests {
+		statuses := []status.BackupStatus{{Source: "Acer", MissingFiles: test.missing, Error: test.error}}
+		fired, resolved, current := check(rules, statuses, active)
+		if len(fired) != test.fired || len(resolved) != test.resolved || len(current) != test.current {
+			t.Errorf("check %d: fired %v, resolved %v, current %v; expected %d, %d, %d",
+				i, fired, resolved, current, test.fired, test.resolved, test.current)
+		}
+	}
+	// Alerts for sources no longer checked are dropped.
+	check(rules, []status.BackupStatus{{Source: "Acer", MissingFiles: 20}}, active)
+	if _, _, current := check(rules, nil, active); len(current) != 0 {
+		t.Errorf("current %v, expected none", current)
+	}
+}
+
+func TestHighestSeverity(t *testing.T) {
+	alerts := []Alert{{Severity: config.SEVERITY_INFO}, {Severity: config.SEVERITY_CRITICAL}, {Severity: config.SEVERITY_WARNING}}
+	if got := HighestSeverity(alerts); got != config.SEVERITY_CRITICAL {
+		t.Errorf("got %s, expected %s", got, config.SEVERITY_CRITICAL)
+	}
+	if got := HighestSeverity(nil); got != "" {
+		t.Errorf("no alerts: got %q", got)
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+// A versioned JSON mirror of the html pages, for scripting against the reporter.
+// Each handler uses the same fetch/validate functions as its corresponding page,
+// so that the api and the pages cannot disagree.
+// Test:  curl -s http://localhost:8090/api/v1/status
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reporter/config"
+	"reporter/logging"
+	"reporter/mail"
+	"reporter/manifest"
+	"reporter/settings"
+	"reporter/status"
+	"strings"
+)
+
+const (
+	PREFIX = "/api/v1" // All api routes are served under this prefix
+)
+
+type StatusResponse struct {
+	Error    string
+	Statuses []status.BackupStatus // One per Source, each with its own Error
+	PollTime string                // When the Statuses were fetched
+}
+
+type HistoryResponse struct {
+	Error    string
+	History  []status.BackupStatus // Each tagged with its Source and FolderId
+	Total    int                   // Records that pass the filter
+	Page     int
+	Pages    int
+	PageSize int // Zero if not paged
+}
+
+type LoggingResponse struct {
+	Message  string
+	Settings []logging.Setting
+	LogLines []string
+}
+
+type SettingsResponse struct {
+	Success           bool
+	Message           string
+	Settings          []settings.Setting
+	AutoEmailSettings []settings.AutoEmailSetting
+}
+
+type SendResponse struct {
+	Report  string
+	Message string
+}
+
+// Adds the api routes to the router, under PREFIX
+func Register(router *mux.Router) {
+	r := router.PathPrefix(PREFIX).Subrouter()
+	r.HandleFunc("/status", StatusApi).Methods(http.MethodGet)
+	r.HandleFunc("/status/refresh", RefreshApi).Methods(http.MethodPost)
+	r.HandleFunc("/history", HistoryApi).Methods(http.MethodGet)
+	r.HandleFunc("/manifest", ManifestApi).Methods(http.MethodGet)
+	r.HandleFunc("/logging", LoggingApi).Methods(http.MethodGet)
+	r.HandleFunc("/settings", SettingsApi).Methods(http.MethodGet, http.MethodPost, http.MethodPut)
+	r.HandleFunc("/reports/{report}/send", SendReportApi).Methods(http.MethodPost)
+	r.HandleFunc("/reports/{report}/preview", PreviewReportApi).Methods(http.MethodGet)
+}
+
+// Returns the latest BackupStatus for each source, as shown on the home page.
+func StatusApi(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, statusResponse(status.Latest()))
+}
+
+// Polls the sources now and returns the fresh BackupStatuses.
+// Test:  curl -s -X POST http://localhost:8090/api/v1/status/refresh
+func RefreshApi(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, statusResponse(status.Refresh()))
+}
+
+func statusResponse(snapshot status.Snapshot) StatusResponse {
+	return StatusResponse{
+		Error:    snapshot.Error,
+		Statuses: snapshot.Statuses,
+		PollTime: snapshot.Time,
+	}
+}
+
+// Returns the history records selected by the same query parameters as the history page
+// (see status.ParseHistoryFilter); all of them by default, unpaged unless a page is given.
+// Test:  curl -s 'http://localhost:8090/api/v1/history?source=Acer&page=1&pageSize=10'
+func HistoryApi(w http.ResponseWriter, r *http.Request) {
+	filter, err := status.ParseExportFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	response := HistoryResponse{Page: filter.Page, PageSize: filter.PageSize}
+	all, err := status.FilterHistory(filter)
+	if err != nil {
+		response.Error = err.Error()
+	}
+	response.Total = len(all)
+	response.History, response.Pages = filter.Paginate(all)
+	writeJson(w, http.StatusOK, response)
+}
+
+// Returns the manifest diff of each source with a manifest, or just the one selected by ?source=
+// Test:  curl -s 'http://localhost:8090/api/v1/manifest?source=Acer'
+func ManifestApi(w http.ResponseWriter, r *http.Request) {
+	diffs, err := manifest.GetDiffs(r.URL.Query().Get("source"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, http.StatusOK, diffs)
+}
+
+// Returns log lines selected by the query parameters LogType, StartDate and MaxLines,
+// which have the same meaning (and defaults) as on the logging page.
+// Test:  curl -s 'http://localhost:8090/api/v1/logging?LogType=SIMMON&MaxLines=10'
+func LoggingApi(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	logType := q.Get("LogType")
+	if logType == "" {
+		logType = "REPORTER"
+	}
+	maxLines := q.Get("MaxLines")
+	if maxLines == "" {
+		maxLines = "100"
+	}
+	vars, valid := logging.Retrieve(logType, q.Get("StartDate"), maxLines)
+	response := LoggingResponse{
+		Message:  vars.Message,
+		Settings: vars.Settings,
+		LogLines: vars.LogLines,
+	}
+	code := http.StatusOK
+	if !valid {
+		code = http.StatusBadRequest
+	}
+	writeJson(w, code, response)
+}
+
+// GET returns the settings as shown on the settings page, with secrets redacted.
+// POST/PUT takes a json object (or form) of field names to values, using the same
+// names as the settings page form. Fields that are not supplied keep their current
+// value, as do secrets sent back as REDACTED or empty (a secret is removed by sending
+// <Id>_Clear as "checked"). The response is as for GET, with any
+// validation errors marked; nothing is saved unless every field validates.
+// Test:  curl -s -X POST -d '{"DialTimeout":"20"}' http://localhost:8090/api/v1/settings
+func SettingsApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		vars := settings.GetPageVariables()
+		writeJson(w, http.StatusOK, settingsResponse(vars, true))
+		return
+	}
+	values, err := readValues(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	form := settings.GetForm()
+	for k, v := range values {
+		if len(v) > 0 {
+			form.Set(k, v[0])
+		}
+	}
+	// Secrets sent back as they were received are left unchanged.
+	for _, s := range settings.GetPageVariables().Settings {
+		if s.Secret && form.Get(s.Id) == settings.REDACTED {
+			form.Set(s.Id, "")
+		}
+	}
+	vars, success := settings.ApplyForm(form)
+	code := http.StatusOK
+	if !success {
+		code = http.StatusBadRequest
+	}
+	writeJson(w, code, settingsResponse(vars, success))
+}
+
+// Asks the report's mailer to send it now (it is queued in the outbox as usual), as the
+// settings page Send Now button does. An ALERT report is only sent if an alert has fired
+// or resolved.
+// Test:  curl -s -X POST http://localhost:8090/api/v1/reports/STATUS/send
+func SendReportApi(w http.ResponseWriter, r *http.Request) {
+	report := mux.Vars(r)["report"]
+	key, ok := config.ReportKey(report)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("unknown report "+report))
+		return
+	}
+	if err := config.EmailImmediate(key); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJson(w, http.StatusAccepted, SendResponse{Report: report, Message: "The " + report + " report is being sent"})
+}
+
+// Returns the report as it would be sent now, without sending it (see mail.GetPreview).
+// Test:  curl -s http://localhost:8090/api/v1/reports/HISTORY/preview
+func PreviewReportApi(w http.ResponseWriter, r *http.Request) {
+	report := mux.Vars(r)["report"]
+	key, ok := config.ReportKey(report)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("unknown report "+report))
+		return
+	}
+	preview, err := mail.GetPreview(key)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, http.StatusOK, preview)
+}
+
+func settingsResponse(vars settings.SettingsPageVariables, success bool) SettingsResponse {
+	response := SettingsResponse{
+		Success:           success,
+		Message:           vars.SuccessMessage,
+		Settings:          vars.Settings,
+		AutoEmailSettings: vars.AutoEmailSettings,
+	}
+	for s := 0; s < len(response.Settings); s++ {
+		if response.Settings[s].Secret && response.Settings[s].IsSet {
+			response.Settings[s].Value = settings.REDACTED
+		}
+	}
+	return response
+}
+
+// Reads the request body as either a json object of strings, or a url-encoded form.
+// The content is checked rather than the Content-Type, since curl -d sends json
+// labelled as a form.
+func readValues(r *http.Request) (url.Values, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+		return url.ParseQuery(string(body))
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	for k, v := range fields {
+		values.Set(k, v)
+	}
+	return values, nil
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Print("ERROR: api json encoding error: ", err)
+	}
+}
+
+type errorResponse struct {
+	Error string
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, errorResponse{Error: err.Error()})
+}
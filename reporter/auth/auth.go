@@ -0,0 +1,343 @@
+package auth
+
+// Login for the pages and the api. The users (each with a bcrypt password hash and a role)
+// are kept in the UsersFile, and are added or updated with the -adduser flag. A viewer may
+// use the status, history and manifest pages (and their api); an admin may also use the
+// settings and logging pages, which can change the config or show its details.
+// After logging in at /login, the pages use a session cookie, and their POST forms must
+// return the session's csrf token (see CsrfToken). The api and /metrics also accept http
+// basic auth, and api requests using the cookie must send the token as X-CSRF-Token.
+// If there are no users, then authentication is disabled.
+// Test:  curl -s -u admin:secret http://localhost:8090/api/v1/settings
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reporter/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROLE_VIEWER = "viewer"
+	ROLE_ADMIN  = "admin"
+
+	SESSION_COOKIE = "syncbox_session"
+	CSRF_FIELD     = "csrf"         // Of the POST forms
+	CSRF_HEADER    = "X-CSRF-Token" // Of api requests using the session cookie
+)
+
+// The paths (and those below them) that need the admin role.
+var adminPaths = []string{"/settings", "/logging", "/outbox", "/preview", "/api/v1/settings", "/api/v1/logging",
+	"/api/v1/reports"}
+
+type User struct {
+	Name         string
+	PasswordHash string // bcrypt
+	Role         string // ROLE_VIEWER or ROLE_ADMIN
+}
+
+// The logged in user of a request.
+type Session struct {
+	User    string
+	Role    string
+	Csrf    string // Empty for basic auth, which needs no csrf token
+	Expires time.Time
+}
+
+type contextKey int
+
+const sessionKey contextKey = 0
+
+var sessions = map[string]*Session{} // By the session cookie's value
+var sessionsMutex = &sync.Mutex{}
+
+var users []User
+var usersPath string
+var usersModTime time.Time
+var usersMutex = &sync.Mutex{}
+
+// Returns the path of the users file.
+func UsersPath(c config.Configuration) string {
+	if c.UsersFile != "" {
+		return c.UsersFile
+	}
+	return config.Beside("users.json")
+}
+
+// Returns the users, reading the users file again if it has changed.
+// A missing file has no users.
+func getUsers() []User {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	path := UsersPath(config.Get())
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: users file %s: %s\n", path, err)
+		}
+		users, usersPath = nil, path
+		return nil
+	}
+	if path == usersPath && info.ModTime().Equal(usersModTime) {
+		return users
+	}
+	content, err := ioutil.ReadFile(path)
+	var read []User
+	if err == nil {
+		err = json.Unmarshal(content, &read)
+	}
+	if err != nil {
+		// Keep the previous users rather than lock everyone out (or let everyone in).
+		log.Printf("ERROR: reading users file %s: %s\n", path, err)
+		return users
+	}
+	users, usersPath, usersModTime = read, path, info.ModTime()
+	log.Printf("auth: loaded %d users from %s\n", len(users), path)
+	return users
+}
+
+// Returns the user if the name and password match.
+func authenticate(name, password string) (User, bool) {
+	for _, u := range getUsers() {
+		if u.Name == name {
+			if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil {
+				return u, true
+			}
+			return User{}, false
+		}
+	}
+	return User{}, false
+}
+
+// Adds the user to the users file, or updates its password and role. The password is read
+// from the reader (the first line), eg:  echo secret | reporter -adduser admin:admin
+func AddUser(nameRole string, passwordReader io.Reader) error {
+	parts := strings.SplitN(nameRole, ":", 2)
+	name, role := parts[0], ROLE_VIEWER
+	if len(parts) == 2 {
+		role = parts[1]
+	}
+	if name == "" || (role != ROLE_VIEWER && role != ROLE_ADMIN) {
+		return errors.New("expected name:role, with a role of " + ROLE_VIEWER + " or " + ROLE_ADMIN)
+	}
+	password, _ := bufio.NewReader(passwordReader).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("no password given (on the first line of stdin)")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	updated := []User{}
+	for _, u := range getUsers() {
+		if u.Name != name {
+			updated = append(updated, u)
+		}
+	}
+	updated = append(updated, User{Name: name, PasswordHash: string(hash), Role: role})
+	content, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := UsersPath(config.Get())
+	if err = config.WriteFileAtomic(path, content, 0600); err != nil {
+		return err
+	}
+	log.Printf("auth: set user %s (%s) in %s\n", name, role, path)
+	return nil
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("FATAL: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Starts a session for the user and sets its cookie.
+func startSession(w http.ResponseWriter, r *http.Request, u User) {
+	hours := config.Get().SessionHours
+	if hours <= 0 {
+		hours = 24
+	}
+	session := &Session{User: u.Name, Role: u.Role, Csrf: randomToken(), Expires: time.Now().Add(time.Duration(hours) * time.Hour)}
+	token := randomToken()
+	sessionsMutex.Lock()
+	sessions[token] = session
+	sessionsMutex.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name: SESSION_COOKIE, Value: token, Path: "/", Expires: session.Expires,
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the unexpired session of the request's cookie, if any.
+func cookieSession(r *http.Request) (string, *Session) {
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return "", nil
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	session := sessions[cookie.Value]
+	if session == nil {
+		return "", nil
+	}
+	if time.Now().After(session.Expires) {
+		delete(sessions, cookie.Value)
+		return "", nil
+	}
+	return cookie.Value, session
+}
+
+// Returns the session as of the current users file, since the user may have been given
+// another role (or removed) since logging in.
+func current(session *Session) *Session {
+	for _, u := range getUsers() {
+		if u.Name == session.User {
+			updated := *session
+			updated.Role = u.Role
+			return &updated
+		}
+	}
+	return nil
+}
+
+// Returns the session of the request (as set by Middleware), or nil if authentication is disabled.
+func CurrentSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionKey).(*Session)
+	return session
+}
+
+// Returns the csrf token that the request's POST forms must return as the CSRF_FIELD.
+func CsrfToken(r *http.Request) string {
+	if session := CurrentSession(r); session != nil {
+		return session.Csrf
+	}
+	return ""
+}
+
+func isApi(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/metrics"
+}
+
+func needsAdmin(path string) bool {
+	for _, p := range adminPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the login (and role, and csrf token) of each request, except for the login page
+// and the static assets.
+func Middleware(staticDir string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			if path == "/login" || strings.HasPrefix(path, staticDir) || len(getUsers()) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			_, session := cookieSession(r)
+			if session != nil {
+				session = current(session)
+			}
+			if session == nil && isApi(path) {
+				if name, password, ok := r.BasicAuth(); ok {
+					if u, ok := authenticate(name, password); ok {
+						session = &Session{User: u.Name, Role: u.Role}
+					}
+				}
+			}
+			if session == nil {
+				if isApi(path) || r.Method != http.MethodGet {
+					w.Header().Set("WWW-Authenticate", `Basic realm="syncbox"`)
+					http.Error(w, "login required", http.StatusUnauthorized)
+				} else {
+					http.Redirect(w, r, "/login?next="+template.URLQueryEscaper(r.URL.RequestURI()), http.StatusSeeOther)
+				}
+				return
+			}
+			if session.Csrf != "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				token := r.Header.Get(CSRF_HEADER)
+				if token == "" && !isApi(path) {
+					token = r.PostFormValue(CSRF_FIELD) // The api body is not a form, so is not parsed
+				}
+				if subtle.ConstantTimeCompare([]byte(token), []byte(session.Csrf)) != 1 {
+					log.Printf("ERROR: auth: bad csrf token from %s for %s %s\n", session.User, r.Method, path)
+					http.Error(w, "bad or missing csrf token", http.StatusForbidden)
+					return
+				}
+			}
+			if needsAdmin(path) && session.Role != ROLE_ADMIN {
+				http.Error(w, "forbidden for the "+session.Role+" role", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey, session)))
+		})
+	}
+}
+
+type LoginPageVariables struct {
+	LocalServer bool
+	Error       string
+	Next        string // Where to go after logging in
+}
+
+// Shows the login form, and for POST checks the user and starts a session.
+func LoginPage(w http.ResponseWriter, r *http.Request) {
+	vars := LoginPageVariables{LocalServer: true, Next: r.FormValue("next")}
+	// Only redirect within this server.
+	if !strings.HasPrefix(vars.Next, "/") || strings.HasPrefix(vars.Next, "//") {
+		vars.Next = "/"
+	}
+	if r.Method == http.MethodPost {
+		if u, ok := authenticate(r.PostFormValue("user"), r.PostFormValue("password")); ok {
+			log.Printf("auth: %s logged in from %s\n", u.Name, r.RemoteAddr)
+			startSession(w, r, u)
+			http.Redirect(w, r, vars.Next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("ERROR: auth: failed login for %s from %s\n", r.PostFormValue("user"), r.RemoteAddr)
+		vars.Error = "Unknown user or wrong password"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	t, err := template.ParseFiles("auth/login.html")
+	if err != nil {
+		log.Print("ERROR: LoginPage template parsing error: ", err)
+		return
+	}
+	if err = t.Execute(w, vars); err != nil {
+		log.Print("ERROR: LoginPage template executing error: ", err)
+	}
+}
+
+// Ends the session (POST, with the csrf token) and returns to the login page.
+func LogoutPage(w http.ResponseWriter, r *http.Request) {
+	if token, session := cookieSession(r); session != nil {
+		sessionsMutex.Lock()
+		delete(sessions, token)
+		sessionsMutex.Unlock()
+		log.Printf("auth: %s logged out\n", session.User)
+	}
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
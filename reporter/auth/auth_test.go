@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reporter/config"
+	"strings"
+	"testing"
+)
+
+// Uses a copy of the sample config in a new directory, so the users file is beside it.
+func useTempConfig(t *testing.T) {
+	content, err := ioutil.ReadFile("../config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Path(path)
+}
+
+func TestAddUser(t *testing.T) {
+	useTempConfig(t)
+	tests := []struct {
+		nameRole string
+		password string
+		valid    bool
+	}{
+		{"ann:admin", "first\n", true},
+		{"vic", "secret\r\n", true}, // A viewer by default
+		{"ann:admin", "second", true},
+		{"bob:owner", "secret\n", false},
+		{":admin", "secret\n", false},
+		{"bob:viewer", "\n", false},
+	}
+	for _, test := range tests {
+		if err := AddUser(test.nameRole, strings.NewReader(test.password)); (err == nil) != test.valid {
+			t.Errorf("AddUser(%q): got %v, expected valid %v", test.nameRole, err, test.valid)
+		}
+	}
+	if users := getUsers(); len(users) != 2 || users[0].Role != ROLE_VIEWER || users[1].Role != ROLE_ADMIN {
+		t.Errorf("users %+v, expected vic (viewer) and ann (admin)", users)
+	}
+	for _, test := range []struct {
+		name     string
+		password string
+		ok       bool
+	}{
+		{"ann", "second", true},
+		{"ann", "first", false}, // Replaced
+		{"vic", "secret", true},
+		{"vic", "secret\r", false},
+		{"bob", "secret", false},
+	} {
+		if _, ok := authenticate(test.name, test.password); ok != test.ok {
+			t.Errorf("authenticate(%s, %s): got %v, expected %v", test.name, test.password, ok, test.ok)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	useTempConfig(t)
+	handler := Middleware("/static/")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	if code := get("/settings"); code != http.StatusOK {
+		t.Errorf("no users: got %d, expected authentication disabled", code)
+	}
+
+	for nameRole, password := range map[string]string{"ann:admin": "annpw", "vic:viewer": "vicpw"} {
+		if err := AddUser(nameRole, strings.NewReader(password)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Returns the cookie and csrf token of a new session.
+	login := func(name string) (*http.Cookie, string) {
+		w := httptest.NewRecorder()
+		startSession(w, httptest.NewRequest(http.MethodPost, "/login", nil), User{Name: name, Role: ROLE_VIEWER})
+		cookie := w.Result().Cookies()[0]
+		_, session := cookieSession(&http.Request{Header: http.Header{"Cookie": {cookie.String()}}})
+		return cookie, session.Csrf
+	}
+	annCookie, annCsrf := login("ann") // The role is taken from the users file
+	vicCookie, vicCsrf := login("vic")
+
+	tests := []struct {
+		method string
+		path   string
+		user   string // Logged in with a session, or with basic auth as "name:password"
+		csrf   string // The form field, or the header for the api
+		want   int
+	}{
+		{"GET", "/", "", "", http.StatusSeeOther},
+		{"GET", "/login", "", "", http.StatusOK},
+		{"GET", "/static/local.css", "", "", http.StatusOK},
+		{"GET", "/api/v1/status", "", "", http.StatusUnauthorized},
+		{"POST", "/settings", "", "", http.StatusUnauthorized},
+		{"GET", "/", "vic", "", http.StatusOK},
+		{"GET", "/settings", "vic", "", http.StatusForbidden},
+		{"GET", "/settings", "ann", "", http.StatusOK},
+		{"POST", "/settings", "ann", "", http.StatusForbidden},
+		{"POST", "/settings", "ann", "wrong", http.StatusForbidden},
+		{"POST", "/settings", "ann", annCsrf, http.StatusOK},
+		{"POST", "/settings", "ann", vicCsrf, http.StatusForbidden},
+		{"POST", "/history", "vic", vicCsrf, http.StatusOK},
+		{"PUT", "/api/v1/settings", "ann", annCsrf, http.StatusOK},
+		{"PUT", "/api/v1/settings", "ann", "", http.StatusForbidden},
+		// Basic auth is only for the api, and needs no csrf token
+		{"GET", "/api/v1/status", "vic:vicpw", "", http.StatusOK},
+		{"GET", "/metrics", "vic:vicpw", "", http.StatusOK},
+		{"GET", "/api/v1/status", "vic:wrong", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/settings", "vic:vicpw", "", http.StatusForbidden},
+		{"PUT", "/api/v1/settings", "ann:annpw", "", http.StatusOK},
+		{"GET", "/", "ann:annpw", "", http.StatusSeeOther},
+	}
+	for _, test := range tests {
+		var r *http.Request
+		if test.method == "POST" && !isApi(test.path) {
+			form := url.Values{CSRF_FIELD: {test.csrf}}
+			r = httptest.NewRequest(test.method, test.path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(test.method, test.path, nil)
+			if test.csrf != "" {
+				r.Header.Set(CSRF_HEADER, test.csrf)
+			}
+		}
+		switch test.user {
+		case "":
+		case "ann":
+			r.AddCookie(annCookie)
+		case "vic":
+			r.AddCookie(vicCookie)
+		default:
+			parts := strings.SplitN(test.user, ":", 2)
+			r.SetBasicAuth(parts[0], parts[1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s as %q (csrf %.6s): got %d, expected %d", test.method, test.path, test.user, test.csrf, w.Code, test.want)
+		}
+	}
+}
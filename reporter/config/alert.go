@@ -0,0 +1,106 @@
+package config
+
+// The metrics, operators and severities of the AlertRules (evaluated by the alert package),
+// so that the rules are checked with the rest of the config.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_CRITICAL = "critical"
+)
+
+// In increasing order.
+var AlertSeverities = []string{SEVERITY_INFO, SEVERITY_WARNING, SEVERITY_CRITICAL}
+
+// The kinds of value that a rule can test.
+const (
+	METRIC_NUMBER   = 1
+	METRIC_DURATION = 2 // An age, as parsed by ParseAge
+	METRIC_STRING   = 3
+)
+
+// The values of a BackupStatus that a rule can test, and their kinds.
+var AlertMetrics = map[string]int{
+	"MissingFiles":  METRIC_NUMBER,
+	"MissingBytes":  METRIC_NUMBER,
+	"BackedUpFiles": METRIC_NUMBER,
+	"BackedUpBytes": METRIC_NUMBER,
+	"SourceFiles":   METRIC_NUMBER,
+	"SourceBytes":   METRIC_NUMBER,
+	"SourceAge":     METRIC_DURATION,
+	"State":         METRIC_STRING, // From syncthing, eg idle, scanning, syncing
+	"PullErrors":    METRIC_NUMBER, // From syncthing
+	"NeedFiles":     METRIC_NUMBER, // From syncthing
+	"NeedBytes":     METRIC_NUMBER, // From syncthing
+	"Error":         METRIC_STRING, // Why the status could not be fully fetched
+}
+
+// Checks that the rule's metric, operator, value and severity make sense together.
+func CheckAlertRule(rule AlertRule) error {
+	kind, ok := AlertMetrics[rule.Metric]
+	if !ok {
+		return fmt.Errorf("unknown metric '%s'", rule.Metric)
+	}
+	if !contains(AlertSeverities, rule.Severity) {
+		return fmt.Errorf("unknown severity '%s' (info, warning or critical)", rule.Severity)
+	}
+	switch rule.Op {
+	case "==", "!=":
+	case ">", ">=", "<", "<=":
+		if kind == METRIC_STRING {
+			return fmt.Errorf("operator '%s' cannot be used with %s", rule.Op, rule.Metric)
+		}
+	default:
+		return fmt.Errorf("unknown operator '%s'", rule.Op)
+	}
+	switch kind {
+	case METRIC_NUMBER:
+		if _, err := strconv.ParseInt(rule.Value, 10, 64); err != nil {
+			return fmt.Errorf("value '%s' is not a whole number", rule.Value)
+		}
+	case METRIC_DURATION:
+		if _, err := ParseAge(rule.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses an age like "3d", "12h", "1w2d" or "67300h4m" (as in BackupStatus.SourceAge).
+// The units d (days) and w (weeks) are allowed in addition to those of time.ParseDuration.
+func ParseAge(age string) (time.Duration, error) {
+	var total time.Duration
+	rest := strings.TrimSpace(age)
+	for _, unit := range []struct {
+		suffix   string
+		duration time.Duration
+	}{{"w", 7 * 24 * time.Hour}, {"d", 24 * time.Hour}} {
+		if i := strings.Index(rest, unit.suffix); i > 0 {
+			n, err := strconv.Atoi(rest[:i])
+			if err != nil {
+				return 0, fmt.Errorf("age '%s' is not valid", age)
+			}
+			total += time.Duration(n) * unit.duration
+			rest = rest[i+1:]
+		}
+	}
+	if rest != "" {
+		d, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("age '%s' is not valid", age)
+		}
+		total += d
+	}
+	if age == "" {
+		return 0, errors.New("age is empty")
+	}
+	return total, nil
+}
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		age   string
+		valid bool
+		want  time.Duration
+	}{
+		{"3d", true, 72 * time.Hour},
+		{"12h", true, 12 * time.Hour},
+		{"1w2d", true, 9 * 24 * time.Hour},
+		{"67300h4m", true, 67300*time.Hour + 4*time.Minute},
+		{"2d6h30m", true, 54*time.Hour + 30*time.Minute},
+		{"", false, 0},
+		{"3 days", false, 0},
+		{"xd", false, 0},
+		{"5", false, 0},
+	}
+	for _, test := range tests {
+		got, err := ParseAge(test.age)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseAge(%q): got %v, expected valid %v", test.age, err, test.valid)
+		} else if got != test.want {
+			t.Errorf("ParseAge(%q): got %s, expected %s", test.age, got, test.want)
+		}
+	}
+}
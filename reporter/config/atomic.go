@@ -0,0 +1,44 @@
+package config
+
+// The reporter often runs on a Pi whose power may be cut at any time, so files that are
+// rewritten (the config, its secrets, the json history) are replaced atomically: a reader,
+// or the next start, sees either the old content or the new, never a truncated file.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Writes the content to a temp file beside the path, syncs it to disk, then renames it
+// over the path (and syncs the directory, so that the rename itself survives a crash).
+func WriteFileAtomic(path string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync() // Not supported everywhere, so errors are ignored
+		d.Close()
+	}
+	return nil
+}
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -15,32 +17,192 @@ const (
 )
 
 type AutoEmailConfig struct {
-	AutoEmailEnable bool
-	AutoEmailCount  int
-	AutoEmailPeriod string
-	AutoEmailNext   string
+	AutoEmailEnable   bool
+	AutoEmailCount    int
+	AutoEmailPeriod   string
+	AutoEmailSchedule string // A cron expression (see cron.go); if set, used instead of the Count and Period
+	AutoEmailNext     string
+	AutoEmailCatchUp  string // For reports missed (eg while the reporter was off); skip, once or each [skip]
+
+	AutoEmailLastMissed string // Describes the last reports that were missed (set by the mailer)
+}
+
+const (
+	CATCHUP_SKIP = "skip" // The missed reports are not sent
+	CATCHUP_ONCE = "once" // A single report is sent, for all those missed
+	CATCHUP_EACH = "each" // A report is sent for each missed
+)
+
+var CatchUpPolicies = []string{CATCHUP_SKIP, CATCHUP_ONCE, CATCHUP_EACH}
+
+// A syncthing folder being monitored. Its expected state comes from the Sources that feed it.
+type SyncFolder struct {
+	Id   string // From the syncthing-gui.
+	Name string // Shown on pages and reports, defaults to the Id.
+
+	// Directory of the folder on this server, for listing the backed up files.
+	// If empty, the files are listed using the syncthing api.
+	LocalPath string `json:",omitempty"`
+}
+
+// Returns the Name, or the Id if no name was given.
+func (f SyncFolder) Label() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.Id
+}
+
+// A machine whose files are backed up to a SyncFolder. It periodically writes a status
+// report file (containing its own syncthing status for the folder) which is compared
+// against the local syncthing status.
+type Source struct {
+	Name           string // Identifies the machine on pages and reports, and tags its history records.
+	StatusFilePath string // Location of file containing the SourceStatus, read on demand or file-change.
+	TimeZone       string // Applied to the SourceStatus date/time strings; a zone name or abbreviation.
+	FolderId       string // The SyncFolder that this machine feeds.
+	ManifestPath   string `json:",omitempty"` // Location of the (optional) manifest of the machine's files, as json lines.
+}
+
+// A channel that reports are sent over (see the notify package for the types).
+type NotifierConfig struct {
+	Name    string   // Identifies the channel in the log.
+	Type    string   // One of smtp, webhook, ntfy, gotify or maildir.
+	Url     string   // Where webhook/ntfy/gotify messages are posted.
+	Token   string   // Access token for ntfy/gotify. A secret (see secrets.go).
+	Path    string   // Directory of the maildir.
+	Reports []string // Names of the reports (eg HISTORY, STATUS) sent over this channel; empty for all.
+}
+
+// Returns true if the report with the key name is sent over this channel.
+func (n NotifierConfig) Handles(keyName string) bool {
+	return handles(n.Reports, keyName)
+}
+
+const (
+	RECIPIENT_TO  = "To"
+	RECIPIENT_CC  = "Cc"
+	RECIPIENT_BCC = "Bcc"
+)
+
+var RecipientKinds = []string{RECIPIENT_TO, RECIPIENT_CC, RECIPIENT_BCC}
+
+const (
+	EMAIL_TLS_IMPLICIT = "implicit" // Tls from the start, usually on port 465
+	EMAIL_TLS_STARTTLS = "starttls" // Upgraded to tls after connecting, usually on port 587
+	EMAIL_TLS_NONE     = "none"     // Unencrypted, eg to a local relay on port 25
+
+	EMAIL_AUTH_PLAIN    = "PLAIN"
+	EMAIL_AUTH_LOGIN    = "LOGIN"
+	EMAIL_AUTH_CRAM_MD5 = "CRAM-MD5"
+	EMAIL_AUTH_NONE     = "none"
+)
+
+var EmailTlsModes = []string{EMAIL_TLS_IMPLICIT, EMAIL_TLS_STARTTLS, EMAIL_TLS_NONE}
+var EmailAuthMechanisms = []string{EMAIL_AUTH_PLAIN, EMAIL_AUTH_LOGIN, EMAIL_AUTH_CRAM_MD5, EMAIL_AUTH_NONE}
+
+// Returns the port, tls mode and auth mechanism used to send email, with the defaults
+// applied for those that are not set.
+func (c Configuration) EmailTransport() (port int, tlsMode string, auth string) {
+	port, tlsMode, auth = c.EmailPort, c.EmailTls, c.EmailAuth
+	if tlsMode == "" {
+		tlsMode = EMAIL_TLS_IMPLICIT
+	}
+	if port == 0 {
+		switch tlsMode {
+		case EMAIL_TLS_STARTTLS:
+			port = 587
+		case EMAIL_TLS_NONE:
+			port = 25
+		default:
+			port = 465
+		}
+	}
+	if c.EmailUserName == "" {
+		auth = EMAIL_AUTH_NONE
+	} else if auth == "" {
+		auth = EMAIL_AUTH_PLAIN
+	}
+	return port, tlsMode, auth
+}
+
+// An address that reports are emailed to.
+type Recipient struct {
+	Address string   // eg me@gmail.com
+	Kind    string   // One of To, Cc or Bcc [To]
+	Reports []string // Names of the reports (eg HISTORY, STATUS) emailed to this address; empty for all.
+}
+
+// Returns true if the report with the key name is emailed to this recipient.
+func (r Recipient) Handles(keyName string) bool {
+	return handles(r.Reports, keyName)
+}
+
+// Returns true if the report is one of the reports, or there are none (meaning all).
+func handles(reports []string, keyName string) bool {
+	if len(reports) == 0 {
+		return true
+	}
+	for _, report := range reports {
+		if report == keyName {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the addresses that the report with the key name is emailed to, by kind.
+func (c Configuration) Addressees(keyName string) (to, cc, bcc []string) {
+	for _, r := range c.Recipients {
+		if !r.Handles(keyName) {
+			continue
+		}
+		switch r.Kind {
+		case RECIPIENT_CC:
+			cc = append(cc, r.Address)
+		case RECIPIENT_BCC:
+			bcc = append(bcc, r.Address)
+		default:
+			to = append(to, r.Address)
+		}
+	}
+	return to, cc, bcc
+}
+
+// A condition on a fresh BackupStatus that raises an alert, eg MissingFiles > 10
+// (see the alert package for the metrics).
+type AlertRule struct {
+	Name     string // Identifies the rule in alerts.
+	Metric   string // eg MissingFiles, MissingBytes, SourceAge, State, PullErrors
+	Op       string // One of == != > >= < <=
+	Value    string // A number, an age (eg 3d, 12h) for SourceAge, or text for State/Error.
+	Severity string // One of info, warning or critical.
 }
 
 // The following config data is stored in a file at ConfigPath
 // Read/write access should be done using Path/Get/Set to make it thread safe.
 // Path() must be called before Get() or Set()
 type Configuration struct {
-	DialTimeout     int    // Retry count for the initial connection.
-	Port            string // port for serving html [8090]
-	AcerFilePath    string // Location of file containing AcerStatus, read on demand or file-change.
-	AcerTimeZone    string // Applied to AcerStatus date/time strings.
-	SyncApiEndpoint string // Where syncthing status is obtained from.
-	SyncApiKey      string // Form the syncthing-gui advanced page.
-	SyncFolderId    string // As above.
+	ConfigVersion   int          // Of the file's format; older files are upgraded on load (see migrate.go).
+	DialTimeout     int          // Retry count for the initial connection.
+	Port            string       // port for serving html [8090]
+	SyncApiEndpoint string       // Where syncthing status is obtained from.
+	SyncApiKey      string       // Form the syncthing-gui advanced page. A secret (see secrets.go).
+	SyncFolders     []SyncFolder // The folders being monitored.
+	Sources         []Source     // The machines feeding the folders, each producing its own BackupStatus.
 
 	DocRoot    string // path to root of served documents (may be absolute or relative to wd) [./]
 	AssetsRoot string // path to static documents (may be absolute or relative to wd) [./static]
 
-	EnableAcerFileWatch   bool // when the AcerFilePath changes, add new record to HistoryFile and email status
-	AcerFileWatchPeriod   int  // Polling period in seconds
+	EnableSourceFileWatch bool // when a StatusFilePath changes, add new records to HistoryFile and email status
+	SourceFileWatchPeriod int  // Polling period in seconds
 	HistoryFileAutoAppend bool // At history report email time, add new record to HistoryFile
 
-	HistoryFile         string // Where the BackupStatus records are appended to.
+	HistoryFile         string // Where the BackupStatus records are appended to (HistoryStore json), or imported from (bolt).
+	HistoryStore        string // Either "bolt" (a database at HistoryDbPath) or "json" (lines in HistoryFile) [bolt]
+	HistoryDbPath       string // Defaults to the HistoryFile path with a .db extension.
+	HistoryKeepAllDays  int    // Every record is kept for this many days, then only the last of each day [0 = all kept]
+	HistoryKeepDays     int    // Records older than this many days are removed [0 = kept forever]
 	HistoryLogAutoEmail AutoEmailConfig
 
 	ReporterLogFilePath  string
@@ -50,10 +212,37 @@ type Configuration struct {
 	SimmonLogAutoEmail AutoEmailConfig
 
 	EmailFrom     string
-	EmailTo       string
-	EmailUserName string
-	EmailPassword string
+	Recipients    []Recipient // Who each report is emailed to.
 	EmailHost     string
+	EmailPort     int    // [465 for implicit tls, 587 for starttls, 25 for none]
+	EmailTls      string // One of implicit, starttls or none (eg for a local relay) [implicit]
+	EmailAuth     string // One of PLAIN, LOGIN, CRAM-MD5 or none [PLAIN, or none without an EmailUserName]
+	EmailUserName string
+	EmailPassword string // A secret (see secrets.go).
+
+	OutboxPath        string // Reports waiting to be sent (see the outbox package) [outbox.json beside the config]
+	OutboxExpiryHours int    // Unsent reports are dropped after this many hours [24]
+
+	SecretsPath    string // The encrypted store of the secrets [the config path with a .secrets extension]
+	SecretsKeyFile string // Holds the key text, unless SYNCBOX_SECRETS_KEY is set [secrets.key beside the config]
+
+	EnableTls       bool   // Serve https on the Port (see the server package)
+	TlsCertFile     string // [cert.pem beside the config, generated (self-signed) if it and the key are missing]
+	TlsKeyFile      string // [key.pem beside the config]
+	TlsRedirectPort string // If set, plain http on this port is redirected to https
+
+	UsersFile    string // The users allowed to log in (see the auth package) [users.json beside the config]
+	SessionHours int    // How long a login lasts [24]
+
+	Notifiers []NotifierConfig // Channels for the reports; if empty then all reports are emailed.
+
+	AlertRules       []AlertRule // Evaluated against each fresh BackupStatus.
+	AlertCheckPeriod int         // Polling period in seconds for evaluating the AlertRules.
+
+	StatusPollPeriod int // Polling period in seconds for the latest BackupStatuses [60]
+
+	EnableSyncEvents    bool // Follow the syncthing event stream, to keep the latest BackupStatuses current
+	SyncEventsAutoEmail bool // Send the STATUS report when a folder becomes idle after syncing (needs EnableSyncEvents)
 }
 
 var configPath string
@@ -61,11 +250,18 @@ var configuration Configuration // Current config, not used directly outside of
 var cached bool
 var mutex = &sync.Mutex{}
 
+const (
+	IMMEDIATE_TIMEOUT = 10 * time.Second // For a mailer to accept CONTROL_EMAIL_IMMEDIATE
+)
+
 const (
 	KEY_HISTORY  = 1
 	KEY_REPORTER = 2
 	KEY_SIMMON   = 3
 	KEY_STATUS   = 4
+	KEY_ALERT    = 5
+	KEY_POLLER   = 6 // Not a report; the status poller
+	KEY_EVENTS   = 7 // Not a report; the syncthing event subscriber
 )
 
 var KeyName = map[int]string{
@@ -73,6 +269,22 @@ var KeyName = map[int]string{
 	KEY_REPORTER: "REPORTER",
 	KEY_SIMMON:   "SIMMON",
 	KEY_STATUS:   "STATUS",
+	KEY_ALERT:    "ALERT",
+	KEY_POLLER:   "POLLER",
+	KEY_EVENTS:   "EVENTS",
+}
+
+// The keys of the reports (the other keys are of background goroutines).
+var ReportKeys = []int{KEY_HISTORY, KEY_REPORTER, KEY_SIMMON, KEY_STATUS, KEY_ALERT}
+
+// Returns the key of the report with the name.
+func ReportKey(name string) (int, bool) {
+	for _, key := range ReportKeys {
+		if KeyName[key] == name {
+			return key, true
+		}
+	}
+	return 0, false
 }
 
 const (
@@ -96,6 +308,20 @@ func ReloadConfig(key int) {
 	MailerControl[key] <- CONTROL_CONFIG_CHANGE
 }
 
+// Asks the mailer of the report to send it now. Unlike ReloadConfig this gives up (with
+// an error) if the mailer is busy, since it is called from the pages and the api.
+func EmailImmediate(key int) error {
+	log.Printf("EmailImmediate, %s ==> %s\n", MsgName[CONTROL_EMAIL_IMMEDIATE], KeyName[key])
+	timer := time.NewTimer(IMMEDIATE_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case MailerControl[key] <- CONTROL_EMAIL_IMMEDIATE:
+		return nil
+	case <-timer.C:
+		return errors.New("the " + KeyName[key] + " mailer is busy; try again later")
+	}
+}
+
 func Path(path string) {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -103,6 +329,13 @@ func Path(path string) {
 	cached = false // force reload upon next call to Get
 }
 
+// Returns the path of the named file in the directory of the config file.
+func Beside(name string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return filepath.Join(filepath.Dir(configPath), name)
+}
+
 // Returns a copy of the current configuration, loading from the
 // previously specified path if not already available in the current cache.
 func Get() Configuration {
@@ -115,9 +348,35 @@ func Get() Configuration {
 		cached = true
 	}
 	config := configuration
+	// Slices are not, so copy them to keep the cached config private.
+	config.SyncFolders = append([]SyncFolder(nil), configuration.SyncFolders...)
+	config.Sources = append([]Source(nil), configuration.Sources...)
+	config.Notifiers = append([]NotifierConfig(nil), configuration.Notifiers...)
+	config.AlertRules = append([]AlertRule(nil), configuration.AlertRules...)
+	config.Recipients = append([]Recipient(nil), configuration.Recipients...)
 	return config
 }
 
+// Returns the monitored folder with the specified id.
+func (c Configuration) Folder(id string) (SyncFolder, bool) {
+	for _, f := range c.SyncFolders {
+		if f.Id == id {
+			return f, true
+		}
+	}
+	return SyncFolder{}, false
+}
+
+// Returns the source machine with the specified name.
+func (c Configuration) Source(name string) (Source, bool) {
+	for _, s := range c.Sources {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Source{}, false
+}
+
 // Assigns new values for the configuration, overwriting the current value
 // and also writing out to the config path.
 func Set(config Configuration) error {
@@ -132,19 +391,93 @@ func Set(config Configuration) error {
 // Loads a new config and returns (a copy)
 func load() Configuration {
 	log.Println("config: loading from path: ", configPath)
-	content, err := ioutil.ReadFile(configPath)
+	fileModTime = modTime(configPath)
+	config, err := read(configPath)
 	if err != nil {
-		log.Fatal("FATAL: ", err)
-	}
-	// Ref: https://blog.golang.org/json-and-go
-	config := Configuration{}
-	if err := json.Unmarshal(content, &config); err != nil {
-		log.Fatal("FATAL: ", err)
+		// eg truncated by a power cut; restore the last config that was read or written.
+		log.Println("ERROR: config: ", err)
+		goodPath := lastGoodPath()
+		var goodErr error
+		if config, goodErr = read(goodPath); goodErr != nil {
+			log.Fatal("FATAL: ", err, "; and the last known good config: ", goodErr)
+		}
+		log.Println("config: using the last known good config: ", goodPath)
+		if content, err := ioutil.ReadFile(configPath); err == nil {
+			if backupPath, err := backup(configPath, content); err == nil {
+				log.Println("config: the failed file is kept at: ", backupPath)
+			}
+		}
+		if err := write(config); err != nil {
+			log.Println("ERROR: config: restoring the last known good config: ", err)
+		}
 	}
 	log.Println("config: loaded")
 	return config
 }
 
+// Returns the path of the copy of the last config file that was read or written successfully.
+func lastGoodPath() string {
+	return configPath + ".good"
+}
+
+// Reads the config (and its secrets) from the file at path (the configPath, or its last good copy).
+func read(path string) (Configuration, error) {
+	config := Configuration{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	previous := content
+	content, applied, err := migrate(content)
+	if err != nil {
+		if _, ok := err.(*json.SyntaxError); !ok {
+			return config, err
+		} // else reported by checkContent
+	}
+	// Ref: https://blog.golang.org/json-and-go
+	problems := checkContent(content, &config)
+	if !HasErrors(problems) {
+		problems = append(problems, Validate(config)...)
+	}
+	for _, p := range problems {
+		log.Println("config: " + p.String())
+	}
+	if HasErrors(problems) {
+		return config, errors.New("invalid config " + path + " (see the errors above)")
+	}
+	secrets, err := readSecrets(config)
+	if err != nil {
+		return config, errors.New("reading secrets: " + err.Error())
+	}
+	// Any plaintext secrets in the config file replace those of the store, and are moved there.
+	plaintext := extractSecrets(&config)
+	for name, value := range plaintext {
+		secrets[name] = value
+	}
+	applySecrets(&config, secrets)
+	if len(applied) > 0 {
+		backupPath, err := backup(path, previous)
+		if err != nil {
+			return config, err
+		}
+		logMigrations(path, applied)
+		log.Println("config: the previous file is kept at: ", backupPath)
+	}
+	if len(plaintext) > 0 {
+		log.Println("config: moving secrets to: ", SecretsPath(config))
+	}
+	if len(applied) > 0 || len(plaintext) > 0 {
+		if err := write(config); err != nil {
+			return config, err
+		}
+	} else if path == configPath {
+		if err := WriteFileAtomic(lastGoodPath(), previous, 0600); err != nil {
+			log.Println("ERROR: config: saving the last known good config: ", err)
+		}
+	}
+	return config, nil
+}
+
 // Write the current configuration to the configPath.
 // Json errors are fatal but file errors are returned.
 func save(config Configuration) error {
@@ -153,15 +486,34 @@ func save(config Configuration) error {
 		log.Println("Error: saving config: ", err.Error())
 		return err
 	}
+	if err := write(config); err != nil {
+		log.Println("Error: saving config: ", err.Error())
+		return err
+	}
+	log.Println("config: saved to path: ", configPath)
+	return nil
+}
+
+// Writes the secrets of the config to the secrets store, and the rest to the configPath
+// (and, if it has no errors, its last good copy), each atomically.
+func write(config Configuration) error {
+	config.ConfigVersion = CONFIG_VERSION
+	good := !HasErrors(Validate(config))
+	config.Notifiers = append([]NotifierConfig(nil), config.Notifiers...)
+	if err := writeSecrets(config, extractSecrets(&config)); err != nil {
+		return err
+	}
 	content, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		log.Fatal("FATAL: ", err)
 	}
-	err = ioutil.WriteFile(configPath, content, 0666)
-	if err != nil {
-		log.Println("Error: saving config: ", err.Error())
+	if err = WriteFileAtomic(configPath, content, 0600); err != nil {
 		return err
 	}
-	log.Println("config: saved to path: ", configPath)
-	return nil
+	fileModTime = modTime(configPath) // So that Watch ignores our own writes
+	if !good {
+		log.Println("ERROR: config: not saved as the last known good config, it has errors")
+		return nil
+	}
+	return WriteFileAtomic(lastGoodPath(), content, 0600)
 }
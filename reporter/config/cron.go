@@ -0,0 +1,194 @@
+package config
+
+// Cron expressions for the AutoEmailSchedule, as an alternative to every AutoEmailCount
+// AutoEmailPeriods. The five fields are: minute hour day-of-month month day-of-week, eg
+//   "0 8 * * MON"     every Monday at 08:00
+//   "30 7 1 * *"      the 1st of each month at 07:30
+//   "0 */6 * * *"     every 6 hours, on the hour
+// Each field is *, or a list of values, ranges (a-b) and steps (*/n, a-b/n). Months and
+// days may be names (JAN, MON); Sunday is 0 or 7. As in cron, if both the day-of-month and
+// the day-of-week are restricted (neither starts with *) then a day matching either is
+// used. The macros @hourly, @daily, @weekly, @monthly and @yearly are also allowed.
+// Times are in the local time zone, by the clock on the wall: across a daylight saving
+// change "0 8 * * *" still fires at 08:00, a time that is skipped (eg 02:30 when the clocks
+// go forward) does not fire that day, and a time that repeats fires only once.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CRON_SEARCH_YEARS = 8 // Far enough to find the next Feb 29
+)
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+var monthNames = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+var dayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// A parsed cron expression; each field is the set of matching values.
+type Cron struct {
+	minutes, hours, days, months, weekdays []bool
+	anyDay, anyWeekday                     bool // The field started with *
+}
+
+// Parses the cron expression (or macro).
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("'%s' has %d fields, not 5 (minute hour day month weekday)", expr, len(fields))
+	}
+	// As in (vixie) cron, a day field starting with * (eg */2) means that a day must match
+	// both day fields, rather than either.
+	c := &Cron{anyDay: strings.HasPrefix(fields[2], "*"), anyWeekday: strings.HasPrefix(fields[4], "*")}
+	var err error
+	if c.minutes, err = parseCronField(fields[0], "minute", 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hours, err = parseCronField(fields[1], "hour", 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.days, err = parseCronField(fields[2], "day", 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.months, err = parseCronField(fields[3], "month", 1, 12, monthNames); err != nil {
+		return nil, err
+	}
+	if c.weekdays, err = parseCronField(fields[4], "weekday", 0, 7, dayNames); err != nil {
+		return nil, err
+	}
+	c.weekdays[0] = c.weekdays[0] || c.weekdays[7] // Sunday is 0 or 7
+	return c, nil
+}
+
+// Returns the values (indexed from 0) matched by the field. The names, if any, are of the
+// values from min.
+func parseCronField(field, name string, min, max int, names []string) ([]bool, error) {
+	values := make([]bool, max+1)
+	value := func(s string) (int, error) {
+		for i, n := range names {
+			if strings.EqualFold(s, n) {
+				return min + i, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("%s '%s' is not in %d-%d", name, s, min, max)
+		}
+		return v, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("%s step '%s' is not a positive number", name, part[i+1:])
+			}
+			rangePart = part[:i]
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = value(bounds[0]); err != nil {
+				return nil, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = value(bounds[1]); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				to = max // eg 5/15 means from 5 on
+			}
+			if to < from {
+				return nil, fmt.Errorf("%s range '%s' is backwards", name, rangePart)
+			}
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Returns true if the date's day matches the day-of-month and day-of-week fields.
+func (c *Cron) matchesDay(t time.Time) bool {
+	day, weekday := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Returns the first time after the given time that the expression matches, in the time's
+// location, or the zero time if there is none (eg for Feb 30).
+func (c *Cron) Next(after time.Time) time.Time {
+	loc := after.Location()
+	y, m, d := after.Date()
+	for i := 0; i < CRON_SEARCH_YEARS*366; i++ {
+		date := time.Date(y, m, d+i, 0, 0, 0, 0, loc) // Normalised to a real date
+		if !c.months[int(date.Month())] || !c.matchesDay(date) {
+			continue
+		}
+		for hour := 0; hour < 24; hour++ {
+			if !c.hours[hour] {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if !c.minutes[minute] {
+					continue
+				}
+				t := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, loc)
+				if t.Hour() != hour || t.Minute() != minute {
+					continue // Skipped by a daylight saving change
+				}
+				if t.After(after) {
+					return t
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// Returns the next count times after the given time that the expression matches.
+func (c *Cron) NextTimes(after time.Time, count int) []time.Time {
+	var times []time.Time
+	for len(times) < count {
+		after = c.Next(after)
+		if after.IsZero() {
+			break
+		}
+		times = append(times, after)
+	}
+	return times
+}
+
+// Returns an error if the expression is invalid or never matches.
+func CheckCron(expr string) error {
+	c, err := ParseCron(expr)
+	if err != nil {
+		return err
+	}
+	if c.Next(time.Now()).IsZero() {
+		return errors.New("'" + expr + "' never fires")
+	}
+	return nil
+}
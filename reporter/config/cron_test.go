@@ -0,0 +1,162 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+const testTimeFormat = "2006-01-02 15:04 MST"
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"* * * FOO *",
+		"* * * * MONDAY",
+		"@fortnightly",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): expected an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		expr  string
+		after string
+		want  []string // The next times, in order
+	}{
+		{"* * * * *", "2026-10-18 10:07", []string{"2026-10-18 10:08", "2026-10-18 10:09"}},
+		{"*/15 * * * *", "2026-10-18 10:07", []string{"2026-10-18 10:15", "2026-10-18 10:30", "2026-10-18 10:45", "2026-10-18 11:00"}},
+		{"5/15 * * * *", "2026-10-18 10:07", []string{"2026-10-18 10:20", "2026-10-18 10:35", "2026-10-18 10:50", "2026-10-18 11:05"}},
+		{"0 9-17/4 * * *", "2026-10-18 10:00", []string{"2026-10-18 13:00", "2026-10-18 17:00", "2026-10-19 09:00"}},
+		{"0,30 8 * * *", "2026-10-18 08:00", []string{"2026-10-18 08:30", "2026-10-19 08:00"}},
+		{"30 7 1 * *", "2026-10-18 00:00", []string{"2026-11-01 07:30", "2026-12-01 07:30", "2027-01-01 07:30"}},
+		// Names, and Sunday as 0 or 7
+		{"0 8 * * MON", "2026-10-18 00:00", []string{"2026-10-19 08:00", "2026-10-26 08:00"}},
+		{"0 8 * * mon-wed", "2026-10-18 00:00", []string{"2026-10-19 08:00", "2026-10-20 08:00", "2026-10-21 08:00", "2026-10-26 08:00"}},
+		{"0 8 * * SUN", "2026-10-17 00:00", []string{"2026-10-18 08:00", "2026-10-25 08:00"}},
+		{"0 8 * * 7", "2026-10-17 00:00", []string{"2026-10-18 08:00", "2026-10-25 08:00"}},
+		{"0 8 1 JAN,jul *", "2026-10-18 00:00", []string{"2027-01-01 08:00", "2027-07-01 08:00"}},
+		// Both day fields restricted: a day matching either
+		{"0 8 13 * FRI", "2026-10-01 00:00", []string{"2026-10-02 08:00", "2026-10-09 08:00", "2026-10-13 08:00", "2026-10-16 08:00"}},
+		// A day field starting with * means a day matching both: odd days that are Mondays,
+		// and 1sts that are Sun, Tue, Thu or Sat
+		{"0 8 */2 * MON", "2026-10-01 00:00", []string{"2026-10-05 08:00", "2026-10-19 08:00", "2026-11-09 08:00", "2026-11-23 08:00"}},
+		{"0 8 1 * */2", "2026-09-30 00:00", []string{"2026-10-01 08:00", "2026-11-01 08:00", "2026-12-01 08:00", "2027-04-01 08:00"}},
+		// Macros
+		{"@daily", "2026-10-18 10:00", []string{"2026-10-19 00:00", "2026-10-20 00:00"}},
+		{"@weekly", "2026-10-18 10:00", []string{"2026-10-25 00:00"}},
+		{"@monthly", "2026-10-18 10:00", []string{"2026-11-01 00:00"}},
+		{"@yearly", "2026-10-18 10:00", []string{"2027-01-01 00:00"}},
+		// Feb 29 is searched for, years ahead; Feb 30 never comes
+		{"0 0 29 2 *", "2026-03-01 00:00", []string{"2028-02-29 00:00", "2032-02-29 00:00"}},
+		{"0 0 30 2 *", "2026-03-01 00:00", nil},
+		{"0 0 31 4,6 *", "2026-03-01 00:00", nil},
+	}
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %s", test.expr, err)
+			continue
+		}
+		got := c.NextTimes(utc(test.after), len(test.want)+1)
+		if len(test.want) == 0 {
+			if len(got) != 0 {
+				t.Errorf("%q after %s: got %v, expected none", test.expr, test.after, got)
+			}
+			continue
+		}
+		for i, want := range test.want {
+			if i >= len(got) || !got[i].Equal(utc(want)) {
+				t.Errorf("%q after %s: got %v, expected %v", test.expr, test.after, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// Across the daylight saving changes, the times are by the clock on the wall.
+func TestCronNextDaylightSaving(t *testing.T) {
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Skip("no time zone data: ", err)
+	}
+	local := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, sydney)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// In 2026 the clocks go forward at 02:00 on 4 October (02:00-03:00 is skipped), and
+	// back at 03:00 on 5 April (02:00-03:00 repeats).
+	tests := []struct {
+		expr  string
+		after string
+		want  []string // Formatted with the zone, to tell the repeated times apart
+	}{
+		{"0 8 * * *", "2026-10-03 09:00", []string{"2026-10-04 08:00 AEDT", "2026-10-05 08:00 AEDT"}},
+		{"0 8 * * *", "2026-04-04 09:00", []string{"2026-04-05 08:00 AEST", "2026-04-06 08:00 AEST"}},
+		{"30 2 * * *", "2026-10-03 09:00", []string{"2026-10-05 02:30 AEDT"}},
+		{"0 * 4 10 *", "2026-10-04 00:30", []string{"2026-10-04 01:00 AEST", "2026-10-04 03:00 AEDT"}},
+		{"30 2 * * *", "2026-04-04 09:00", []string{"2026-04-05 02:30 AEST", "2026-04-06 02:30 AEST"}},
+	}
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %s", test.expr, err)
+			continue
+		}
+		got := c.NextTimes(local(test.after), len(test.want))
+		var gotFormatted []string
+		for _, tm := range got {
+			gotFormatted = append(gotFormatted, tm.Format(testTimeFormat))
+		}
+		if len(gotFormatted) != len(test.want) {
+			t.Errorf("%q after %s: got %v, expected %v", test.expr, test.after, gotFormatted, test.want)
+			continue
+		}
+		for i := range test.want {
+			if gotFormatted[i] != test.want[i] {
+				t.Errorf("%q after %s: got %v, expected %v", test.expr, test.after, gotFormatted, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCheckCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"0 8 * * MON", true},
+		{"@hourly", true},
+		{"0 0 29 2 *", true},
+		{"0 0 30 2 *", false}, // Never fires
+		{"0 8 * *", false},
+	}
+	for _, test := range tests {
+		if err := CheckCron(test.expr); (err == nil) != test.valid {
+			t.Errorf("CheckCron(%q): got %v, expected valid %v", test.expr, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package config
+
+// The config file carries its ConfigVersion. A file older than CONFIG_VERSION is upgraded
+// on load by the migrations after its version, in order; each works on the file's json
+// (rather than the Configuration) so that it can read fields that no longer exist.
+// Before the upgraded config is written, the previous file is kept as a timestamped backup.
+// To change the format: add a migration, and increment CONFIG_VERSION to its Version.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_VERSION = 4
+)
+
+type migration struct {
+	Version     int // The ConfigVersion after the migration
+	Description string
+	Apply       func(m map[string]interface{})
+}
+
+var migrations = []migration{
+	{1, "single SyncFolderId/AcerFilePath to SyncFolders and Sources", migrateSources},
+	{2, "AcerFileWatch to SourceFileWatch", migrateFileWatch},
+	{3, "remove the CheckHours/EmailHours/EmailTargets of the original format", migrateOriginal},
+	{4, "EmailTo to Recipients", migrateRecipients},
+}
+
+// Returns the content upgraded to CONFIG_VERSION, and the descriptions of the migrations
+// that were applied (if none, then the content is returned unchanged).
+func migrate(content []byte) ([]byte, []string, error) {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(content, &m); err != nil {
+		return content, nil, err
+	}
+	version := 0
+	if v, ok := m["ConfigVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > CONFIG_VERSION {
+		return content, nil, fmt.Errorf("ConfigVersion %d is newer than this reporter's %d", version, CONFIG_VERSION)
+	}
+	var applied []string
+	for _, mg := range migrations {
+		if mg.Version > version {
+			mg.Apply(m)
+			applied = append(applied, fmt.Sprintf("%d: %s", mg.Version, mg.Description))
+		}
+	}
+	if len(applied) == 0 {
+		return content, nil, nil
+	}
+	m["ConfigVersion"] = CONFIG_VERSION
+	migrated, err := json.MarshalIndent(m, "", "  ")
+	return migrated, applied, err
+}
+
+// Copies the file at path to a timestamped backup beside it, returning the backup's path.
+func backup(path string, content []byte) (string, error) {
+	backupPath := path + "." + time.Now().Format("20060102-150405") + ".bak"
+	if err := WriteFileAtomic(backupPath, content, 0600); err != nil {
+		return "", errors.New("backing up config: " + err.Error())
+	}
+	return backupPath, nil
+}
+
+// Returns the field as a string, or "" if it is missing (or not a string).
+func stringField(m map[string]interface{}, name string) string {
+	s, _ := m[name].(string)
+	return s
+}
+
+// The original single folder (SyncFolderId) fed by a single machine (AcerFilePath,
+// AcerTimeZone), and later folders each with an AcerFilePath, become Sources.
+func migrateSources(m map[string]interface{}) {
+	folders, _ := m["SyncFolders"].([]interface{})
+	if len(folders) == 0 && stringField(m, "SyncFolderId") != "" {
+		folders = []interface{}{map[string]interface{}{
+			"Id": stringField(m, "SyncFolderId"), "AcerFilePath": stringField(m, "AcerFilePath"),
+		}}
+	}
+	sources, _ := m["Sources"].([]interface{})
+	for _, f := range folders {
+		folder, ok := f.(map[string]interface{})
+		if !ok || stringField(folder, "AcerFilePath") == "" {
+			continue
+		}
+		// The single (acer) machine feeding this folder
+		name := "Acer"
+		if len(sources) > 0 {
+			name = "Acer-" + stringField(folder, "Id")
+		}
+		sources = append(sources, map[string]interface{}{
+			"Name": name, "StatusFilePath": folder["AcerFilePath"],
+			"TimeZone": stringField(m, "AcerTimeZone"), "FolderId": folder["Id"],
+		})
+		delete(folder, "AcerFilePath")
+	}
+	if folders != nil {
+		m["SyncFolders"] = folders
+	}
+	if sources != nil {
+		m["Sources"] = sources
+	}
+	delete(m, "SyncFolderId")
+	delete(m, "AcerFilePath")
+	delete(m, "AcerTimeZone")
+}
+
+func migrateFileWatch(m map[string]interface{}) {
+	if enable, ok := m["EnableAcerFileWatch"]; ok {
+		m["EnableSourceFileWatch"] = enable
+	}
+	if period, ok := m["AcerFileWatchPeriod"]; ok {
+		m["SourceFileWatchPeriod"] = period
+	}
+	delete(m, "EnableAcerFileWatch")
+	delete(m, "AcerFileWatchPeriod")
+}
+
+// The check and email periods are now the AutoEmailConfigs; the EmailTargets become the
+// EmailTo (if not already set), as a comma separated list (see migrateRecipients).
+func migrateOriginal(m map[string]interface{}) {
+	if targets, ok := m["EmailTargets"].([]interface{}); ok && stringField(m, "EmailTo") == "" {
+		var addresses []string
+		for _, t := range targets {
+			if target, ok := t.(string); ok && target != "" {
+				addresses = append(addresses, target)
+			}
+		}
+		if len(addresses) > 0 {
+			m["EmailTo"] = strings.Join(addresses, ",")
+		}
+	}
+	delete(m, "CheckHours")
+	delete(m, "EmailHours")
+	delete(m, "EmailTargets")
+}
+
+// The single EmailTo (which may have been a comma separated list) that received every
+// report becomes a Recipient of each address.
+func migrateRecipients(m map[string]interface{}) {
+	recipients, _ := m["Recipients"].([]interface{})
+	for _, address := range strings.Split(stringField(m, "EmailTo"), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			recipients = append(recipients, map[string]interface{}{"Address": address, "Kind": RECIPIENT_TO})
+		}
+	}
+	if recipients != nil {
+		m["Recipients"] = recipients
+	}
+	delete(m, "EmailTo")
+}
+
+// Logs the migrations that were applied.
+func logMigrations(path string, applied []string) {
+	log.Printf("config: upgraded %s to ConfigVersion %d with migrations: %s\n",
+		path, CONFIG_VERSION, strings.Join(applied, "; "))
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string // A config file's json
+		want string // The json after migrating to CONFIG_VERSION
+	}{
+		{
+			"single folder and machine",
+			`{"SyncFolderId": "f1", "AcerFilePath": "/a.txt", "AcerTimeZone": "AEDT"}`,
+			`{"SyncFolders": [{"Id": "f1"}],
+			  "Sources": [{"Name": "Acer", "StatusFilePath": "/a.txt", "TimeZone": "AEDT", "FolderId": "f1"}]}`,
+		},
+		{
+			"folders each with a machine",
+			`{"SyncFolders": [{"Id": "f1", "AcerFilePath": "/a.txt"}, {"Id": "f2"}, {"Id": "f3", "AcerFilePath": "/c.txt"}]}`,
+			`{"SyncFolders": [{"Id": "f1"}, {"Id": "f2"}, {"Id": "f3"}],
+			  "Sources": [{"Name": "Acer", "StatusFilePath": "/a.txt", "TimeZone": "", "FolderId": "f1"},
+			              {"Name": "Acer-f3", "StatusFilePath": "/c.txt", "TimeZone": "", "FolderId": "f3"}]}`,
+		},
+		{
+			"file watch",
+			`{"EnableAcerFileWatch": true, "AcerFileWatchPeriod": 30}`,
+			`{"EnableSourceFileWatch": true, "SourceFileWatchPeriod": 30}`,
+		},
+		{
+			"every email target",
+			`{"CheckHours": 24, "EmailHours": 24, "EmailTargets": ["a@b.c", "d@e.f"]}`,
+			`{"Recipients": [{"Address": "a@b.c", "Kind": "To"}, {"Address": "d@e.f", "Kind": "To"}]}`,
+		},
+		{
+			"email targets with an EmailTo",
+			`{"EmailTo": "x@y.z", "EmailTargets": ["a@b.c"]}`,
+			`{"Recipients": [{"Address": "x@y.z", "Kind": "To"}]}`,
+		},
+		{
+			"comma separated EmailTo",
+			`{"ConfigVersion": 3, "EmailTo": "a@b.c, d@e.f,"}`,
+			`{"Recipients": [{"Address": "a@b.c", "Kind": "To"}, {"Address": "d@e.f", "Kind": "To"}]}`,
+		},
+		{
+			"only the later migrations",
+			`{"ConfigVersion": 3, "AcerFilePath": "/kept.txt", "EmailTo": ""}`,
+			`{"AcerFilePath": "/kept.txt"}`,
+		},
+	}
+	for _, test := range tests {
+		migrated, applied, err := migrate([]byte(test.in))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(applied) == 0 {
+			t.Errorf("%s: no migrations applied", test.name)
+		}
+		got := map[string]interface{}{}
+		want := map[string]interface{}{}
+		if err := json.Unmarshal(migrated, &got); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatalf("%s: bad test: %s", test.name, err)
+		}
+		want["ConfigVersion"] = float64(CONFIG_VERSION)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s\nexpected %v", test.name, migrated, want)
+		}
+	}
+}
+
+func TestMigrateCurrent(t *testing.T) {
+	content := []byte(`{"ConfigVersion": 4, "EmailTo": "left@alone"}`)
+	migrated, applied, err := migrate(content)
+	if err != nil || len(applied) != 0 || string(migrated) != string(content) {
+		t.Errorf("got %s, %v, %v; expected the content unchanged", migrated, applied, err)
+	}
+	if _, _, err := migrate([]byte(`{"ConfigVersion": 99}`)); err == nil {
+		t.Error("a newer ConfigVersion: expected an error")
+	}
+}
+
+// The sample config.json (in the original format) upgrades to a config with no errors.
+func TestMigrateSample(t *testing.T) {
+	content, err := ioutil.ReadFile("../config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, applied, err := migrate(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %v, expected every migration", applied)
+	}
+	var c Configuration
+	problems := checkContent(migrated, &c)
+	problems = append(problems, Validate(c)...)
+	if HasErrors(problems) {
+		t.Errorf("problems: %v", problems)
+	}
+	if c.ConfigVersion != CONFIG_VERSION {
+		t.Errorf("ConfigVersion %d, expected %d", c.ConfigVersion, CONFIG_VERSION)
+	}
+	if len(c.SyncFolders) != 1 || c.SyncFolders[0].Id != "zzecm-apamx" {
+		t.Errorf("SyncFolders %v", c.SyncFolders)
+	}
+	wantSources := []Source{{
+		Name: "Acer", StatusFilePath: "/media/syncdisk/backups/Documents/AcerPC-Sync-Status-Report.txt",
+		TimeZone: "AEDT", FolderId: "zzecm-apamx",
+	}}
+	if !reflect.DeepEqual(c.Sources, wantSources) {
+		t.Errorf("Sources %+v, expected %+v", c.Sources, wantSources)
+	}
+	wantRecipients := []Recipient{
+		{Address: "david.x.weiss@gmail.com", Kind: RECIPIENT_TO},
+		{Address: "dummy@stupid", Kind: RECIPIENT_TO},
+	}
+	if !reflect.DeepEqual(c.Recipients, wantRecipients) {
+		t.Errorf("Recipients %+v, expected %+v", c.Recipients, wantRecipients)
+	}
+}
@@ -0,0 +1,181 @@
+package config
+
+// Secrets (the syncthing api key, the email password and the notifier tokens) are not
+// written to the config file, but to a store encrypted with AES-GCM at SecretsPath
+// [the config path with a .secrets extension]. The key is taken from the environment
+// variable SECRETS_KEY_ENV or else from SecretsKeyFile [secrets.key beside the config],
+// which is generated if it does not exist. Secrets found in the config file (eg written
+// by an older version) are moved into the store when it is loaded.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SECRETS_KEY_ENV = "SYNCBOX_SECRETS_KEY"
+
+	SECRET_SYNC_API_KEY   = "SyncApiKey"
+	SECRET_EMAIL_PASSWORD = "EmailPassword"
+)
+
+// The encrypted store file; Data is the json of the secrets map, sealed with the Nonce.
+type secretsFile struct {
+	Nonce []byte
+	Data  []byte
+}
+
+// Names the secret of a notifier's token in the store.
+func notifierTokenSecret(name string) string {
+	return "Notifier." + name + ".Token"
+}
+
+// Returns the path of the secrets store.
+func SecretsPath(c Configuration) string {
+	if c.SecretsPath != "" {
+		return c.SecretsPath
+	}
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".secrets"
+}
+
+// Returns where the key is taken from; the environment variable or the key file.
+func SecretsKeySource(c Configuration) string {
+	if os.Getenv(SECRETS_KEY_ENV) != "" {
+		return "$" + SECRETS_KEY_ENV
+	}
+	return secretsKeyFile(c)
+}
+
+func secretsKeyFile(c Configuration) string {
+	if c.SecretsKeyFile != "" {
+		return c.SecretsKeyFile
+	}
+	return filepath.Join(filepath.Dir(configPath), "secrets.key")
+}
+
+// Returns the AES-256 key, derived from the key text of the environment or key file.
+func secretsKey(c Configuration) ([]byte, error) {
+	text := os.Getenv(SECRETS_KEY_ENV)
+	if text == "" {
+		path := secretsKeyFile(c)
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			random := make([]byte, 32)
+			if _, err = rand.Read(random); err != nil {
+				return nil, err
+			}
+			content = []byte(hex.EncodeToString(random) + "\n")
+			if err = ioutil.WriteFile(path, content, 0600); err != nil {
+				return nil, err
+			}
+			log.Println("config: generated secrets key file: ", path)
+		} else if err != nil {
+			return nil, err
+		}
+		text = strings.TrimSpace(string(content))
+		if text == "" {
+			return nil, errors.New("empty secrets key file " + path)
+		}
+	}
+	key := sha256.Sum256([]byte(text))
+	return key[:], nil
+}
+
+func secretsCipher(c Configuration) (cipher.AEAD, error) {
+	key, err := secretsKey(c)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Reads and decrypts the secrets store; a missing store has no secrets.
+func readSecrets(c Configuration) (map[string]string, error) {
+	secrets := map[string]string{}
+	content, err := ioutil.ReadFile(SecretsPath(c))
+	if os.IsNotExist(err) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	file := secretsFile{}
+	if err = json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	aead, err := secretsCipher(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, errors.New("bad nonce in " + SecretsPath(c))
+	}
+	data, err := aead.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt " + SecretsPath(c) + " (wrong key?)")
+	}
+	err = json.Unmarshal(data, &secrets)
+	return secrets, err
+}
+
+// Encrypts and writes the secrets store, readable only by the owner.
+func writeSecrets(c Configuration, secrets map[string]string) error {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	aead, err := secretsCipher(c)
+	if err != nil {
+		return err
+	}
+	file := secretsFile{Nonce: make([]byte, aead.NonceSize())}
+	if _, err = rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = aead.Seal(nil, file.Nonce, data, nil)
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(SecretsPath(c), content, 0600)
+}
+
+// Removes the secrets from the config (which must have its own Notifiers) and returns
+// those that were set.
+func extractSecrets(c *Configuration) map[string]string {
+	secrets := map[string]string{}
+	take := func(name string, value *string) {
+		if *value != "" {
+			secrets[name] = *value
+			*value = ""
+		}
+	}
+	take(SECRET_SYNC_API_KEY, &c.SyncApiKey)
+	take(SECRET_EMAIL_PASSWORD, &c.EmailPassword)
+	for i := range c.Notifiers {
+		take(notifierTokenSecret(c.Notifiers[i].Name), &c.Notifiers[i].Token)
+	}
+	return secrets
+}
+
+// Sets the secrets of the config from the store.
+func applySecrets(c *Configuration, secrets map[string]string) {
+	c.SyncApiKey = secrets[SECRET_SYNC_API_KEY]
+	c.EmailPassword = secrets[SECRET_EMAIL_PASSWORD]
+	for i := range c.Notifiers {
+		c.Notifiers[i].Token = secrets[notifierTokenSecret(c.Notifiers[i].Name)]
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Secrets in the config file are moved into the encrypted store when it is loaded.
+func TestSecretsMovedToStore(t *testing.T) {
+	os.Unsetenv(SECRETS_KEY_ENV)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	content := `{"ConfigVersion": 4, "Port": "8090", "SyncApiKey": "api-secret",
+		"SyncApiEndpoint": "http://localhost:8384/rest/db/status", "SyncFolders": [{"Id": "f1"}],
+		"EmailPassword": "mail-secret",
+		"Notifiers": [{"Name": "phone", "Type": "ntfy", "Url": "https://ntfy.sh/x", "Token": "ntfy-secret"}]}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	Path(path)
+	c := Get()
+	if c.SyncApiKey != "api-secret" || c.EmailPassword != "mail-secret" || c.Notifiers[0].Token != "ntfy-secret" {
+		t.Errorf("secrets %q, %q, %q; expected those of the file", c.SyncApiKey, c.EmailPassword, c.Notifiers[0].Token)
+	}
+	for _, file := range []string{path, SecretsPath(c)} {
+		written, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(written), "secret") {
+			t.Errorf("%s has a secret in plain text:\n%s", file, written)
+		}
+	}
+
+	// Read back with the generated key file, but not with another key.
+	secrets, err := readSecrets(c)
+	if err != nil || len(secrets) != 3 || secrets[notifierTokenSecret("phone")] != "ntfy-secret" {
+		t.Errorf("read %v, %v; expected the 3 secrets", secrets, err)
+	}
+	os.Setenv(SECRETS_KEY_ENV, "another key")
+	defer os.Unsetenv(SECRETS_KEY_ENV)
+	if _, err := readSecrets(c); err == nil {
+		t.Error("another key: expected an error")
+	}
+}
+
+func TestExtractSecrets(t *testing.T) {
+	c := Configuration{SyncApiKey: "k", Notifiers: []NotifierConfig{{Name: "a", Token: "t"}, {Name: "b"}}}
+	secrets := extractSecrets(&c)
+	if c.SyncApiKey != "" || c.Notifiers[0].Token != "" {
+		t.Errorf("left %+v", c)
+	}
+	if len(secrets) != 2 || secrets[SECRET_SYNC_API_KEY] != "k" || secrets[notifierTokenSecret("a")] != "t" {
+		t.Errorf("extracted %v", secrets)
+	}
+	applySecrets(&c, secrets)
+	if c.SyncApiKey != "k" || c.EmailPassword != "" || c.Notifiers[0].Token != "t" || c.Notifiers[1].Token != "" {
+		t.Errorf("applied %+v", c)
+	}
+}
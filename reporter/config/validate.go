@@ -0,0 +1,392 @@
+package config
+
+// Checks of the config file, so that every problem is reported at once (at startup, on a
+// reload, or with the -check-config flag) rather than the first failure ending the run.
+// Errors prevent the config from being used; warnings (eg unknown or obsolete fields, and
+// paths that don't exist yet) are only logged.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The periods of an AutoEmailConfig without an AutoEmailSchedule (see settings.CalculateNextTime).
+var AutoEmailPeriods = []string{"secs", "mins", "hours", "days", "weeks"}
+
+var notifierTypes = []string{"smtp", "webhook", "ntfy", "gotify", "maildir"}
+
+type Problem struct {
+	Field   string // eg Sources[1].FolderId
+	Message string
+	Warning bool // The config can still be used
+}
+
+func (p Problem) String() string {
+	level := "ERROR"
+	if p.Warning {
+		level = "WARNING"
+	}
+	if p.Field == "" {
+		return level + ": " + p.Message
+	}
+	return level + ": " + p.Field + ": " + p.Message
+}
+
+// Returns true if any of the problems is an error.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the problems of the config file at the path.
+func CheckFile(path string) []Problem {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []Problem{{Message: err.Error()}}
+	}
+	config := Configuration{}
+	var problems []Problem
+	content, applied, err := migrate(content)
+	if err != nil {
+		if _, ok := err.(*json.SyntaxError); !ok {
+			return []Problem{{Field: "ConfigVersion", Message: err.Error()}}
+		} // else reported by checkContent
+	}
+	for _, a := range applied {
+		problems = append(problems, Problem{Field: "ConfigVersion", Message: "will be upgraded by migration " + a, Warning: true})
+	}
+	problems = append(problems, checkContent(content, &config)...)
+	if HasErrors(problems) {
+		return problems
+	}
+	return append(problems, Validate(config)...)
+}
+
+// Unmarshals the content into the config, returning any syntax or type errors (with their
+// line and column) and the unknown fields.
+func checkContent(content []byte, config *Configuration) []Problem {
+	if err := json.Unmarshal(content, config); err != nil {
+		var offset int64
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			offset = e.Offset
+		case *json.UnmarshalTypeError:
+			offset = e.Offset
+		}
+		message := err.Error()
+		if offset > 0 {
+			line := bytes.Count(content[:offset], []byte("\n")) + 1
+			column := offset - int64(bytes.LastIndexByte(content[:offset], '\n')) - 1
+			message = fmt.Sprintf("line %d column %d: %s", line, column, message)
+		}
+		return []Problem{{Message: message}}
+	}
+	var problems []Problem
+	unknownFields("", content, reflect.TypeOf(*config), &problems)
+	return problems
+}
+
+// Adds a warning for each field of the json that isn't in the type (of a struct, or a
+// slice of them). Fields are matched as by json.Unmarshal, ignoring case.
+func unknownFields(field string, raw json.RawMessage, t reflect.Type, problems *[]Problem) {
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(raw, &object) != nil {
+			return
+		}
+		known := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			} else if name == "" {
+				name = f.Name
+			}
+			known[strings.ToLower(name)] = f.Type
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := key
+			if field != "" {
+				name = field + "." + key
+			}
+			if fieldType, ok := known[strings.ToLower(key)]; ok {
+				unknownFields(name, object[key], fieldType, problems)
+			} else {
+				*problems = append(*problems, Problem{Field: name, Message: "unknown field (ignored)", Warning: true})
+			}
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			return
+		}
+		for i, item := range items {
+			unknownFields(fmt.Sprintf("%s[%d]", field, i), item, t.Elem(), problems)
+		}
+	}
+}
+
+// Returns the problems of the (unmarshalled and converted) config's values.
+func Validate(c Configuration) []Problem {
+	var problems []Problem
+	fail := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...), Warning: true})
+	}
+	// Warns if the path (or for a file that may not exist yet, its directory) doesn't exist.
+	checkPath := func(field, path string, mayBeCreated bool) {
+		if path == "" {
+			return
+		}
+		if mayBeCreated {
+			if _, err := os.Stat(path); err == nil {
+				return
+			}
+			path = filepath.Dir(path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			warn(field, "unreachable path: %s", err)
+		}
+	}
+
+	if c.Port == "" {
+		fail("Port", "required")
+	} else if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		fail("Port", "not a port number: %s", c.Port)
+	}
+	if c.SyncApiEndpoint == "" {
+		fail("SyncApiEndpoint", "required")
+	} else if u, err := url.Parse(c.SyncApiEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("SyncApiEndpoint", "not an http(s) url: %s", c.SyncApiEndpoint)
+	}
+
+	if len(c.SyncFolders) == 0 {
+		fail("SyncFolders", "at least one folder is required")
+	}
+	folderIds := map[string]bool{}
+	for i, f := range c.SyncFolders {
+		field := fmt.Sprintf("SyncFolders[%d]", i)
+		if f.Id == "" {
+			fail(field+".Id", "required")
+		} else if folderIds[f.Id] {
+			fail(field+".Id", "duplicate folder %s", f.Id)
+		}
+		folderIds[f.Id] = true
+		checkPath(field+".LocalPath", f.LocalPath, false)
+	}
+	sourceNames := map[string]bool{}
+	for i, s := range c.Sources {
+		field := fmt.Sprintf("Sources[%d]", i)
+		if s.Name == "" {
+			fail(field+".Name", "required")
+		} else if sourceNames[s.Name] {
+			fail(field+".Name", "duplicate source %s", s.Name)
+		}
+		sourceNames[s.Name] = true
+		if !folderIds[s.FolderId] {
+			fail(field+".FolderId", "not one of the SyncFolders: '%s'", s.FolderId)
+		}
+		if s.StatusFilePath == "" {
+			fail(field+".StatusFilePath", "required")
+		}
+		checkPath(field+".StatusFilePath", s.StatusFilePath, true)
+		checkPath(field+".ManifestPath", s.ManifestPath, true)
+	}
+
+	checkPath("DocRoot", c.DocRoot, false)
+	checkPath("AssetsRoot", c.AssetsRoot, false)
+	checkPath("HistoryFile", c.HistoryFile, true)
+	checkPath("HistoryDbPath", c.HistoryDbPath, true)
+	checkPath("ReporterLogFilePath", c.ReporterLogFilePath, true)
+	checkPath("SimmonLogFilePath", c.SimmonLogFilePath, true)
+	if c.HistoryStore != "" && c.HistoryStore != "bolt" && c.HistoryStore != "json" {
+		fail("HistoryStore", "unknown store '%s' (bolt or json)", c.HistoryStore)
+	}
+	if c.HistoryKeepDays < 0 {
+		fail("HistoryKeepDays", "must not be negative")
+	}
+	if c.HistoryKeepAllDays < 0 {
+		fail("HistoryKeepAllDays", "must not be negative")
+	}
+	if c.EnableSourceFileWatch && c.SourceFileWatchPeriod < 10 {
+		warn("SourceFileWatchPeriod", "at least 10 seconds; 10 is used")
+	}
+	if c.StatusPollPeriod != 0 && c.StatusPollPeriod < 10 {
+		fail("StatusPollPeriod", "0 (the default) or at least 10 seconds")
+	}
+	if c.AlertCheckPeriod < 0 {
+		fail("AlertCheckPeriod", "must not be negative")
+	}
+	ruleNames := map[string]bool{}
+	for i, r := range c.AlertRules {
+		field := fmt.Sprintf("AlertRules[%d]", i)
+		if r.Name == "" {
+			fail(field+".Name", "required")
+		} else if ruleNames[r.Name] {
+			fail(field+".Name", "duplicate rule %s", r.Name)
+		}
+		ruleNames[r.Name] = true
+		if err := CheckAlertRule(r); err != nil {
+			fail(field, "%s", err)
+		}
+	}
+
+	for name, aec := range map[string]AutoEmailConfig{
+		"HistoryLogAutoEmail": c.HistoryLogAutoEmail, "ReporterLogAutoEmail": c.ReporterLogAutoEmail,
+		"SimmonLogAutoEmail": c.SimmonLogAutoEmail,
+	} {
+		if aec.AutoEmailCatchUp != "" && !contains(CatchUpPolicies, aec.AutoEmailCatchUp) {
+			fail(name+".AutoEmailCatchUp", "'%s' is not one of %s", aec.AutoEmailCatchUp, strings.Join(CatchUpPolicies, ", "))
+		}
+		if aec.AutoEmailSchedule != "" {
+			if err := CheckCron(aec.AutoEmailSchedule); err != nil {
+				fail(name+".AutoEmailSchedule", "%s", err)
+			}
+		} else {
+			if aec.AutoEmailEnable || aec.AutoEmailPeriod != "" {
+				if !contains(AutoEmailPeriods, aec.AutoEmailPeriod) {
+					fail(name+".AutoEmailPeriod", "'%s' is not one of %s", aec.AutoEmailPeriod, strings.Join(AutoEmailPeriods, ", "))
+				}
+			}
+			if aec.AutoEmailEnable && aec.AutoEmailCount < 1 {
+				fail(name+".AutoEmailCount", "at least 1")
+			}
+		}
+		if aec.AutoEmailNext != "" {
+			if _, err := time.ParseInLocation(TIME_FORMAT, aec.AutoEmailNext, time.Local); err != nil {
+				fail(name+".AutoEmailNext", "'%s' is not a time like %s", aec.AutoEmailNext, TIME_FORMAT)
+			}
+		}
+	}
+
+	emailed := len(c.Notifiers) == 0
+	notifierNames := map[string]bool{}
+	for i, n := range c.Notifiers {
+		field := fmt.Sprintf("Notifiers[%d]", i)
+		if n.Name == "" {
+			fail(field+".Name", "required")
+		} else if notifierNames[n.Name] {
+			fail(field+".Name", "duplicate notifier %s", n.Name)
+		}
+		notifierNames[n.Name] = true
+		switch n.Type {
+		case "smtp":
+			emailed = true
+		case "webhook", "ntfy", "gotify":
+			if n.Url == "" {
+				fail(field+".Url", "required for %s", n.Type)
+			}
+		case "maildir":
+			if n.Path == "" {
+				fail(field+".Path", "required for maildir")
+			}
+			checkPath(field+".Path", n.Path, true)
+		default:
+			fail(field+".Type", "'%s' is not one of %s", n.Type, strings.Join(notifierTypes, ", "))
+		}
+		for _, report := range n.Reports {
+			if _, ok := ReportKey(report); !ok {
+				fail(field+".Reports", "unknown report '%s'", report)
+			}
+		}
+	}
+	if emailed {
+		for field, value := range map[string]string{"EmailHost": c.EmailHost, "EmailFrom": c.EmailFrom} {
+			if value == "" {
+				warn(field, "required to email the reports")
+			}
+		}
+		if len(c.Recipients) == 0 {
+			warn("Recipients", "at least one is required to email the reports")
+		}
+	}
+	if c.EmailPort < 0 || c.EmailPort > 65535 {
+		fail("EmailPort", "%d is out of range (0 for the default, or 1-65535)", c.EmailPort)
+	}
+	if c.EmailTls != "" && !contains(EmailTlsModes, c.EmailTls) {
+		fail("EmailTls", "'%s' is not one of %s", c.EmailTls, strings.Join(EmailTlsModes, ", "))
+	}
+	if c.EmailAuth != "" && !contains(EmailAuthMechanisms, c.EmailAuth) {
+		fail("EmailAuth", "'%s' is not one of %s", c.EmailAuth, strings.Join(EmailAuthMechanisms, ", "))
+	}
+	if _, tlsMode, auth := c.EmailTransport(); tlsMode == EMAIL_TLS_NONE &&
+		(auth == EMAIL_AUTH_PLAIN || auth == EMAIL_AUTH_LOGIN) && !IsLocalHost(c.EmailHost) {
+		warn("EmailAuth", "%s auth is refused without tls, except to localhost", auth)
+	}
+	for i, r := range c.Recipients {
+		field := fmt.Sprintf("Recipients[%d]", i)
+		if _, err := mail.ParseAddress(r.Address); err != nil {
+			fail(field+".Address", "'%s' is not an email address", r.Address)
+		}
+		if r.Kind != "" && !contains(RecipientKinds, r.Kind) {
+			fail(field+".Kind", "'%s' is not one of %s", r.Kind, strings.Join(RecipientKinds, ", "))
+		}
+		for _, report := range r.Reports {
+			if _, ok := ReportKey(report); !ok {
+				fail(field+".Reports", "unknown report '%s'", report)
+			}
+		}
+	}
+
+	if c.EnableTls && (c.TlsCertFile == "") != (c.TlsKeyFile == "") {
+		fail("TlsCertFile", "TlsCertFile and TlsKeyFile must both be given, or neither (to generate them)")
+	}
+	if c.EnableTls && c.TlsRedirectPort != "" && c.TlsRedirectPort == c.Port {
+		fail("TlsRedirectPort", "must differ from the Port")
+	}
+	checkPath("TlsCertFile", c.TlsCertFile, false)
+	checkPath("TlsKeyFile", c.TlsKeyFile, false)
+	checkPath("UsersFile", c.UsersFile, true)
+	checkPath("OutboxPath", c.OutboxPath, true)
+	if c.OutboxExpiryHours < 0 {
+		fail("OutboxExpiryHours", "must not be negative")
+	}
+	checkPath("SecretsKeyFile", c.SecretsKeyFile, true)
+
+	// Map iteration leaves the problems unordered, so order them by field.
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+	return problems
+}
+
+// Returns true if the host is this machine, where it is safe to send a password without tls.
+func IsLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
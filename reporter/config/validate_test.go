@@ -0,0 +1,52 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAlertRules(t *testing.T) {
+	tests := []struct {
+		rule  AlertRule
+		field string // Of the expected error, or "" for none
+	}{
+		{AlertRule{Name: "missing", Metric: "MissingFiles", Op: ">", Value: "10", Severity: SEVERITY_WARNING}, ""},
+		{AlertRule{Name: "stale", Metric: "SourceAge", Op: ">=", Value: "1w2d", Severity: SEVERITY_CRITICAL}, ""},
+		{AlertRule{Name: "state", Metric: "State", Op: "!=", Value: "idle", Severity: SEVERITY_INFO}, ""},
+		{AlertRule{Metric: "MissingFiles", Op: ">", Value: "10", Severity: SEVERITY_INFO}, "AlertRules[0].Name"},
+		{AlertRule{Name: "r", Metric: "Missing", Op: ">", Value: "10", Severity: SEVERITY_INFO}, "AlertRules[0]"},
+		{AlertRule{Name: "r", Metric: "MissingFiles", Op: "=>", Value: "10", Severity: SEVERITY_INFO}, "AlertRules[0]"},
+		{AlertRule{Name: "r", Metric: "MissingFiles", Op: ">", Value: "ten", Severity: SEVERITY_INFO}, "AlertRules[0]"},
+		{AlertRule{Name: "r", Metric: "SourceAge", Op: ">", Value: "3 days", Severity: SEVERITY_INFO}, "AlertRules[0]"},
+		{AlertRule{Name: "r", Metric: "State", Op: ">", Value: "idle", Severity: SEVERITY_INFO}, "AlertRules[0]"},
+		{AlertRule{Name: "r", Metric: "MissingFiles", Op: ">", Value: "10", Severity: "urgent"}, "AlertRules[0]"},
+	}
+	for _, test := range tests {
+		c := Configuration{
+			Port: "8090", SyncApiEndpoint: "http://localhost:8384/rest/db/status",
+			SyncFolders: []SyncFolder{{Id: "f1"}}, AlertRules: []AlertRule{test.rule},
+		}
+		var errs []string
+		for _, p := range Validate(c) {
+			if !p.Warning && strings.HasPrefix(p.Field, "AlertRules") {
+				errs = append(errs, p.String())
+				if p.Field != test.field {
+					t.Errorf("%+v: %s, expected an error in %q", test.rule, p, test.field)
+				}
+			}
+		}
+		if test.field != "" && len(errs) == 0 {
+			t.Errorf("%+v: no error, expected one in %s", test.rule, test.field)
+		}
+	}
+	c := Configuration{
+		Port: "8090", SyncApiEndpoint: "http://localhost:8384/rest/db/status", SyncFolders: []SyncFolder{{Id: "f1"}},
+		AlertRules: []AlertRule{
+			{Name: "r", Metric: "PullErrors", Op: ">", Value: "0", Severity: SEVERITY_WARNING},
+			{Name: "r", Metric: "NeedFiles", Op: ">", Value: "0", Severity: SEVERITY_WARNING},
+		},
+	}
+	if problems := Validate(c); !HasErrors(problems) || problems[0].Field != "AlertRules[1].Name" {
+		t.Errorf("duplicate rule names: got %v", problems)
+	}
+}
@@ -0,0 +1,84 @@
+package config
+
+// The config file may also be edited by hand (eg over ssh) while the reporter is running.
+// Watch polls the file, and when it has been changed by something other than the reporter
+// it is read again and, if valid, replaces the current config. Every goroutine in the
+// MailerControl is then sent CONTROL_CONFIG_CHANGE, so that it picks up the changes.
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	WATCH_PERIOD = 5 * time.Second // How often the config file is checked for changes
+)
+
+var fileModTime time.Time // Of the config file when last read or written by the reporter
+
+// Returns the modification time of the file, or the zero time if it can't be read.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Polls the config file for changes, reloading it when it changes (see above). Never returns.
+func Watch() {
+	for {
+		time.Sleep(WATCH_PERIOD)
+		if reload() {
+			Broadcast()
+		}
+	}
+}
+
+// Reads the config file again if it has changed since the reporter last read or wrote it.
+// An invalid file is logged and the current config kept. Returns true if the config was replaced.
+func reload() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !cached {
+		return false // Not yet loaded, so the next Get will read the file
+	}
+	changed := modTime(configPath)
+	if changed.IsZero() || changed.Equal(fileModTime) {
+		return false
+	}
+	log.Println("config: file changed, reloading from path: ", configPath)
+	previous := configuration
+	fileModTime = changed
+	config, err := read(configPath)
+	if err == nil {
+		err = checkReload(previous, config)
+	}
+	if err != nil {
+		// Keep the current config, and don't try again until the file changes again.
+		log.Printf("ERROR: config: keeping the current config, the changed file is invalid: %s\n", err)
+		return false
+	}
+	configuration = config
+	log.Println("config: reloaded")
+	return true
+}
+
+// Notes the changes that can't take effect until a restart. The config has been validated by read.
+func checkReload(previous, config Configuration) error {
+	if config.Port != previous.Port || config.EnableTls != previous.EnableTls ||
+		config.TlsCertFile != previous.TlsCertFile || config.TlsKeyFile != previous.TlsKeyFile ||
+		config.TlsRedirectPort != previous.TlsRedirectPort {
+		log.Println("config: changes to the Port or Tls settings need a restart")
+	}
+	return nil
+}
+
+// Tells every goroutine in the MailerControl that the config has changed. Each is sent
+// separately, so that one that is busy (eg in a long poll) doesn't hold up the others.
+func Broadcast() {
+	for key := range MailerControl {
+		go ReloadConfig(key)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"reporter/auth"
 	"reporter/config"
 	"strconv"
 	"strings"
@@ -26,11 +27,12 @@ type Setting struct {
 	Description string
 	// Validator takes a new value (as the entered string). If validation fails
 	// then an error is returned. This field is only used when Readonly = false
-	Validator func(newValue string, fields *ValidatedFormFields) error
+	Validator func(newValue string, fields *ValidatedFormFields) error `json:"-"`
 }
 
 type LoggingPageVariables struct {
 	LocalServer bool
+	Csrf        string // For the form (see auth.CsrfToken)
 	Settings    []Setting
 	Message     string // Any error/success message
 	LogLines    []string
@@ -90,6 +92,7 @@ func getSettings(logType string, startDate string, maxLines string) []Setting {
 func LoggingPage(w http.ResponseWriter, r *http.Request) {
 	loggingPageVars := LoggingPageVariables{
 		LocalServer: true,
+		Csrf:        auth.CsrfToken(r),
 	}
 	fields := ValidatedFormFields{}
 	if r.Method != http.MethodPost {
@@ -99,18 +102,7 @@ func LoggingPage(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		if r.Form.Get("retrieve") == "yes" {
 			loggingPageVars.Settings = getSettings(r.Form.Get("LogType"), r.Form.Get("StartDate"), r.Form.Get("MaxLines"))
-			success := true
-			for s := 0; s < len(loggingPageVars.Settings); s++ {
-				setting := &loggingPageVars.Settings[s]
-				if !setting.Readonly {
-					if err := setting.Validator(setting.Value, &fields); err != nil {
-						setting.Description = err.Error()
-						setting.Errored = "errored"
-						success = false
-					}
-				}
-			}
-			if !success {
+			if !validate(loggingPageVars.Settings, &fields) {
 				fields.LogFilePath = "" // Inhibit LoggingFetch from fetching log lines
 			}
 		}
@@ -118,6 +110,44 @@ func LoggingPage(w http.ResponseWriter, r *http.Request) {
 	LoggingFetch(w, loggingPageVars, fields)
 }
 
+// Validates the form values (as submitted by the logging page or the api) and
+// if they are all valid, reads the selected log lines into the returned variables.
+// Returns false if any setting failed validation.
+func Retrieve(logType, startDate, maxLines string) (LoggingPageVariables, bool) {
+	loggingPageVars := LoggingPageVariables{
+		Settings: getSettings(logType, startDate, maxLines),
+	}
+	fields := ValidatedFormFields{}
+	valid := validate(loggingPageVars.Settings, &fields)
+	if valid {
+		lines, err := readLog(fields.LogFilePath, fields.StartDate, fields.MaxLines)
+		if err == nil {
+			loggingPageVars.LogLines = *lines
+			loggingPageVars.Message = strconv.Itoa(len(*lines)) + " log lines retrieved"
+		} else {
+			loggingPageVars.Message = err.Error()
+		}
+	}
+	return loggingPageVars, valid
+}
+
+// Run the validator for each writeable setting, marking those that fail.
+// Returns true if all settings validated OK.
+func validate(settings []Setting, fields *ValidatedFormFields) bool {
+	success := true
+	for s := 0; s < len(settings); s++ {
+		setting := &settings[s]
+		if !setting.Readonly {
+			if err := setting.Validator(setting.Value, fields); err != nil {
+				setting.Description = err.Error()
+				setting.Errored = "errored"
+				success = false
+			}
+		}
+	}
+	return success
+}
+
 // Fetches logging records from the specified log file, and writes the expanded html string to the parm.
 // If no logFile is specified, then just write the html without any lines.  This is useful for the
 // initial page load. Errors are logged here.
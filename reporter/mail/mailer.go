@@ -1,22 +1,18 @@
 package mail
 
-// ref: https://stackoverflow.com/questions/2591755/how-to-send-html-email-using-linux-command-line
-
 // Ref: https://unix.stackexchange.com/questions/15405/how-do-i-send-html-email-using-linux-mail-command is a
 // good rundown on the various problems and options with unix mail clients.
 // Ref: https://24ways.org/2009/rock-solid-html-emails might be worth a read
-// Ref: https://github.com/go-gomail/gomail and https://godoc.org/gopkg.in/gomail.v2 seems to be the go hah
-// Ref: https://gist.github.com/chrisgillis/10888032  has useful info
+// The reports are delivered over the configured channels by the notify package.
 
-// Watch the specified AcerFilePath (with a poll interval) for changes.
-// When the file changes, then retrieve a current BackupStatus from
+// Watch the StatusFilePath of each Source (with a poll interval) for changes.
+// When a file changes, then retrieve a current BackupStatus from
 // ???, create a HistoryRecord from the two, and send it using the Emailer
 // and also add to the HistoryArchive.
 
 // Refs: https://golang.org/pkg/
 import (
 	"bytes"
-	"gopkg.in/gomail.v2"
 	// "bufio"
 	// "encoding/json"
 	// "github.com/gorilla/mux"
@@ -31,13 +27,65 @@ import (
 	"errors"
 	"fmt"
 	"reporter/config"
+	"reporter/notify"
+	"reporter/outbox"
 	"reporter/settings"
 	"reporter/status"
+	"strconv"
 	"time"
 	// "github.com/go-fsnotify/fsnotify"
 )
 
-type EmailGen func(body *bytes.Buffer) (subject string, err error)
+// Generates a report: writes the html body, optionally adds attachments, and returns the subject.
+type EmailGen func(body *bytes.Buffer, attachments *[]notify.Attachment) (subject string, err error)
+
+const (
+	MAX_MISSED_COUNTED = 1000 // Of the missed times of a periodic report
+	MAX_CATCHUP_SENDS  = 10   // The most reports sent to catch up, by the "each" policy
+)
+
+// When the mailers started; reports missed before this were missed because the reporter
+// was not running.
+var started = time.Now()
+
+// Returned by an EmailGen when there is nothing worth reporting, so nothing is sent.
+var ErrNothingToSend = errors.New("nothing to send")
+
+// The generators used for previews, by report key (set by main). They produce the same
+// report as the mailers' generators, but without their side effects (such as appending
+// to the history, or changing the active alerts).
+var PreviewGens = map[int]EmailGen{}
+
+// A report as it would be sent now.
+type Preview struct {
+	Key           string
+	Subject       string
+	Html          string
+	Attachments   []string // The names of the attachments
+	NothingToSend bool     // Nothing would be sent now (eg no alerts have fired or resolved)
+	Error         string   // Of generating the report (which is still sent, with the error)
+}
+
+// Generates the report with the key, without sending it.
+func GetPreview(key int) (Preview, error) {
+	gen, ok := PreviewGens[key]
+	if !ok {
+		return Preview{}, errors.New("no report " + config.KeyName[key])
+	}
+	var body bytes.Buffer
+	var attachments []notify.Attachment
+	subject, err := gen(&body, &attachments)
+	preview := Preview{Key: config.KeyName[key], Subject: subject, Html: body.String()}
+	if err == ErrNothingToSend {
+		preview.NothingToSend = true
+	} else if err != nil {
+		preview.Error = err.Error()
+	}
+	for _, a := range attachments {
+		preview.Attachments = append(preview.Attachments, a.Name)
+	}
+	return preview, nil
+}
 
 // Waits until the next scheduled email, then sends it, and schedules the next one.
 // The channel is used to alert mailer that the config has changed and to re-load it.
@@ -46,14 +94,31 @@ type EmailGen func(body *bytes.Buffer) (subject string, err error)
 func PeriodicMailer(control <-chan config.ControlMsg, key int, gen EmailGen) {
 	tag := fmt.Sprintf("PeriodicMailer(%s)", config.KeyName[key])
 	log.Printf("%s: starting\n", tag)
+	// Without a valid schedule, waits for a config change, or a request to email now.
+	waitForChange := func() {
+		if waitIndefinite(control) == config.CONTROL_EMAIL_IMMEDIATE {
+			mail(tag, key, gen, "")
+		}
+	}
 	for {
 		aec := getEmailConfig(key)
-		if waitDuration, err := getWaitDuration(tag, aec); err != nil {
+		if missed := missedTimes(aec, time.Now()); len(missed) > 0 {
+			// The reports due while the reporter was not running (or was late) are handled
+			// by the AutoEmailCatchUp policy, then the next time is calculated from now.
+			aec.AutoEmailLastMissed = catchUp(tag, key, gen, aec, missed)
+			if !reschedule(tag, key, aec, time.Now()) {
+				waitForChange()
+			}
+		} else if waitDuration, err := getWaitDuration(tag, aec); err != nil {
 			// The current aec.AutoEmailNext can't be used; advance to the next time and save it.
-			_, aec.AutoEmailNext = settings.CalculateNextTime(time.Now(), aec.AutoEmailCount, aec.AutoEmailPeriod)
-			log.Printf("%s: Calculated new nextTime after %d %s ==> %s\n",
-				tag, aec.AutoEmailCount, aec.AutoEmailPeriod, aec.AutoEmailNext)
-			setEmailConfig(key, aec)
+			// If it is only just ahead (too soon to wait for), then it is skipped.
+			from := time.Now()
+			if next, err := parseNext(aec); err == nil && next.After(from) {
+				from = next
+			}
+			if !reschedule(tag, key, aec, from) {
+				waitForChange()
+			}
 		} else {
 			var msg config.ControlMsg
 			if waitDuration == 0 {
@@ -68,45 +133,177 @@ func PeriodicMailer(control <-chan config.ControlMsg, key int, gen EmailGen) {
 			log.Printf("%s: wait completed, msg: %s\n", tag, config.MsgName[msg])
 			if msg != config.CONTROL_CONFIG_CHANGE {
 				log.Printf("%s: mailing...\n", tag)
-				mail(tag, gen) // Time reached; email the report
+				mail(tag, key, gen, "") // Time reached; email the report
 			}
+			if msg == config.CONTROL_TIMER_EXPIRED {
+				// Schedule the next from this one (rather than from now, which would drift).
+				if next, err := parseNext(aec); err == nil && !reschedule(tag, key, getEmailConfig(key), next) {
+					waitForChange()
+				}
+			}
+		}
+	}
+}
+
+// Calculates and saves the next email time after the time, returning false (having
+// logged the error) if there is no valid schedule or period.
+func reschedule(tag string, key int, aec config.AutoEmailConfig, from time.Time) bool {
+	_, next, err := settings.NextEmailTime(from, aec)
+	if err != nil {
+		log.Printf("ERROR: %s: %s; waiting for a config change\n", tag, err)
+		return false
+	}
+	aec.AutoEmailNext = next
+	log.Printf("%s: Calculated new nextTime after %s ==> %s\n", tag, settings.DescribeSchedule(aec), aec.AutoEmailNext)
+	setEmailConfig(key, aec)
+	return true
+}
+
+func parseNext(aec config.AutoEmailConfig) (time.Time, error) {
+	return time.ParseInLocation(config.TIME_FORMAT, aec.AutoEmailNext, time.Local)
+}
+
+// Returns the times that emails were due (from the AutoEmailNext) up to now, if any; at
+// most MAX_MISSED_COUNTED are returned.
+func missedTimes(aec config.AutoEmailConfig, now time.Time) []time.Time {
+	next, err := parseNext(aec)
+	if !aec.AutoEmailEnable || err != nil || next.After(now) {
+		return nil
+	}
+	missed := []time.Time{next}
+	for len(missed) < MAX_MISSED_COUNTED {
+		t, _, err := settings.NextEmailTime(missed[len(missed)-1], aec)
+		if err != nil || t.After(now) {
+			break
 		}
+		missed = append(missed, t)
 	}
+	return missed
 }
 
-// Simply waits for a control message, either that the acerfile has changed or to reload config.
+// Applies the AutoEmailCatchUp policy to the missed times: nothing is sent (skip), a single
+// report is sent now (once), or a report is sent for each of them (each, at most
+// MAX_CATCHUP_SENDS). Returns a description of what was missed, why, and what was done.
+func catchUp(tag string, key int, gen EmailGen, aec config.AutoEmailConfig, missed []time.Time) string {
+	reason := "the reporter was late (was the machine suspended, or the clock changed?)"
+	if missed[0].Before(started) {
+		reason = "the reporter was not running (started at " + started.Format(config.TIME_FORMAT) + ")"
+	}
+	count := strconv.Itoa(len(missed))
+	if len(missed) == MAX_MISSED_COUNTED {
+		count += " or more"
+	}
+	policy := aec.AutoEmailCatchUp
+	if policy == "" {
+		policy = config.CATCHUP_SKIP
+	}
+	var action string
+	switch policy {
+	case config.CATCHUP_ONCE:
+		mail(tag, key, gen, "catching up on "+count+" missed")
+		action = "sent one report now"
+	case config.CATCHUP_EACH:
+		sends := missed
+		if len(sends) > MAX_CATCHUP_SENDS {
+			sends = sends[len(sends)-MAX_CATCHUP_SENDS:] // The latest
+		}
+		for i, t := range sends {
+			sendGen := gen
+			if previewGen, ok := PreviewGens[key]; ok && i > 0 {
+				sendGen = previewGen // The same report, without appending to the history again
+			}
+			mail(tag, key, sendGen, "catching up on the report due "+t.Format(config.TIME_FORMAT))
+		}
+		action = fmt.Sprintf("sent %d reports now", len(sends))
+	default:
+		action = "skipped them"
+	}
+	description := fmt.Sprintf("%s: missed %s reports due from %s, as %s; %s (catch-up policy %s)",
+		time.Now().Format(config.TIME_FORMAT), count, missed[0].Format(config.TIME_FORMAT), reason, action, policy)
+	log.Printf("%s: %s\n", tag, description)
+	return description
+}
+
+// Simply waits for a control message, either that a source status file has changed or to reload config.
+// A change to a status file adds new records to the history (but is not mailed; see AlertMailer).
+// The report is only mailed on request (CONTROL_EMAIL_IMMEDIATE).
 func WatcherMailer(control <-chan config.ControlMsg, key int, gen EmailGen) {
 	tag := fmt.Sprintf("WatcherMailer(%s)", config.KeyName[key])
 	log.Printf("%s: starting\n", tag)
-	filePath := config.Get().AcerFilePath
-	currentModTime, _ := getModTime(tag, filePath)
-	// Ignore error; modTime will be empty but still comparable to polled value.
+	currentModTimes := getModTimes(tag, config.Get().Sources)
 	for {
 		c := config.Get()
 		var msg config.ControlMsg
-		if !c.EnableAcerFileWatch {
+		if !c.EnableSourceFileWatch {
 			log.Printf("%s: waiting indefinitely...\n", tag)
 			msg = waitIndefinite(control)
 		} else {
-			secs := c.AcerFileWatchPeriod
+			secs := c.SourceFileWatchPeriod
 			if secs < 10 {
 				secs = 10 // Minimum polling period
 			}
-			msg = waitTimed(control, time.Duration(secs) * time.Second)
+			msg = waitTimed(control, time.Duration(secs)*time.Second)
 		}
 		if msg == config.CONTROL_CONFIG_CHANGE {
 			log.Printf("%s: config change occurred\n", tag)
+		} else if msg == config.CONTROL_EMAIL_IMMEDIATE {
+			log.Printf("%s: mailing...\n", tag)
+			mail(tag, key, gen, "")
+		} else {
+			// Timeout: check for a change to any of the sources' files.
+			// A single set of history records covers all the sources.
+			modTimes := getModTimes(tag, config.Get().Sources)
+			changed := false
+			for filePath, modTime := range modTimes {
+				if !modTime.Equal(currentModTimes[filePath]) {
+					changed = true
+				}
+			}
+			if changed {
+				log.Printf("%s: status file changed, appending to history\n", tag)
+				status.AppendToHistory()
+			}
+			currentModTimes = modTimes
+		}
+	}
+}
+
+// Periodically evaluates the AlertRules (by calling the gen), which only produces a report
+// when an alert fires or resolves; otherwise it returns ErrNothingToSend.
+func AlertMailer(control <-chan config.ControlMsg, key int, gen EmailGen) {
+	tag := fmt.Sprintf("AlertMailer(%s)", config.KeyName[key])
+	log.Printf("%s: starting\n", tag)
+	for {
+		c := config.Get()
+		var msg config.ControlMsg
+		if len(c.AlertRules) == 0 {
+			log.Printf("%s: no rules, waiting indefinitely...\n", tag)
+			msg = waitIndefinite(control)
 		} else {
-			// Timeout: check for a file change
-			modTime, err := getModTime(tag, c.AcerFilePath)
-			if err == nil && !modTime.Equal(currentModTime) {
-				mail(tag, gen)
-				currentModTime = modTime
+			secs := c.AlertCheckPeriod
+			if secs < 10 {
+				secs = 10 // Minimum polling period
 			}
+			msg = waitTimed(control, time.Duration(secs)*time.Second)
+		}
+		if msg == config.CONTROL_CONFIG_CHANGE {
+			log.Printf("%s: config change occurred\n", tag)
+		} else {
+			mail(tag, key, gen, "")
 		}
 	}
 }
 
+// Returns the mod time of each source's StatusFilePath. Errors are ignored; the modTime
+// will be empty but still comparable to a later polled value.
+func getModTimes(tag string, sources []config.Source) map[string]time.Time {
+	modTimes := map[string]time.Time{}
+	for _, source := range sources {
+		modTimes[source.StatusFilePath], _ = getModTime(tag, source.StatusFilePath)
+	}
+	return modTimes
+}
+
 func getModTime(tag, filePath string) (time.Time, error) {
 	fi, err := os.Stat(filePath)
 	if err == nil {
@@ -117,23 +314,25 @@ func getModTime(tag, filePath string) (time.Time, error) {
 	}
 }
 
-func mail(tag string, gen EmailGen) {
+// Generates the report and queues it for each of the channels configured for it. The
+// note, if any, is added to the subject.
+func mail(tag string, key int, gen EmailGen, note string) {
 	var body bytes.Buffer
-	subject, _ := gen(&body)
-	m := gomail.NewMessage()
-	c := config.Get()
-	m.SetHeader("From", c.EmailFrom)
-	m.SetHeader("To", c.EmailTo)
-	// m.SetAddressHeader("Cc", "dan@example.com", "Dan")
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body.String())
-	// m.Attach("/home/Alex/lolcat.jpg")
-	d := gomail.NewDialer(c.EmailHost, 465, c.EmailUserName, c.EmailPassword)
-	if err := d.DialAndSend(m); err != nil {
-		log.Printf("ERROR: %s: dialer.DialAndSend error: %v\n", tag, err)
-	} else {
-		log.Printf("%s: emailed OK\n", tag)
+	var attachments []notify.Attachment
+	subject, err := gen(&body, &attachments)
+	if err == ErrNothingToSend {
+		return
+	}
+	if note != "" {
+		subject += " (" + note + ")"
+	}
+	msg := notify.Message{
+		Key:         config.KeyName[key],
+		Subject:     subject,
+		Html:        body.String(),
+		Attachments: attachments,
 	}
+	outbox.Dispatch(tag, &msg)
 }
 
 func getEmailConfig(key int) (emailConfig config.AutoEmailConfig) {
@@ -147,7 +346,7 @@ func getEmailConfig(key int) (emailConfig config.AutoEmailConfig) {
 	case config.KEY_SIMMON:
 		return c.SimmonLogAutoEmail
 	default:
-		log.Fatal("FATAL: getEmailConfig bad key:" + string(key))
+		log.Fatal("FATAL: getEmailConfig bad key:" + strconv.Itoa(key))
 	}
 	return config.AutoEmailConfig{}
 }
@@ -162,7 +361,7 @@ func setEmailConfig(key int, emailConfig config.AutoEmailConfig) {
 	case config.KEY_SIMMON:
 		c.SimmonLogAutoEmail = emailConfig
 	default:
-		log.Fatal("FATAL: setEmailConfig bad key:" + string(key))
+		log.Fatal("FATAL: setEmailConfig bad key:" + strconv.Itoa(key))
 	}
 	config.Set(c)
 	log.Printf("setEmailConfig(%s): Saved email config\n", config.KeyName[key])
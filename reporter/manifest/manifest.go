@@ -0,0 +1,379 @@
+package manifest
+
+// A source machine may publish a manifest of its files (at its ManifestPath) alongside its
+// status file. This is compared against the files backed up in its folder, listed either by
+// walking the folder's LocalPath or from the syncthing api (/rest/db/browse), to show which
+// files are actually missing, rather than just how many.
+// The manifest is json lines, one file per line, with a path relative to the folder root:
+//   {"Path":"docs/a.txt","Size":1234,"ModTime":"2019-02-12T21:50:00+11:00","Hash":"<sha256 hex>"}
+// The Hash is optional; if given (and there is a LocalPath) it is checked for files whose
+// sizes match.
+// Test:  curl -s http://localhost:8090/manifest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reporter/config"
+	"reporter/status"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BROWSE_PATH = "/rest/db/browse"
+)
+
+// A file, as listed in a manifest or found in the backup.
+type FileEntry struct {
+	Path    string // Relative to the folder root, separated by "/"
+	Size    int64
+	ModTime string
+	Hash    string `json:",omitempty"`
+}
+
+// A file that is both in the manifest and backed up, but differs.
+type Mismatch struct {
+	Path         string
+	Reason       string // "size" or "hash"
+	SourceSize   int64
+	BackedUpSize int64
+}
+
+// The difference between a source's manifest and the files backed up in its folder.
+type Diff struct {
+	Source        string
+	FolderId      string
+	FolderName    string
+	Time          string      // When the diff was made
+	SourceFiles   int         // In the manifest
+	BackedUpFiles int         // In the folder
+	Missing       []FileEntry // In the manifest but not backed up
+	Extra         []FileEntry // Backed up but not in the manifest
+	Mismatched    []Mismatch
+	Error         string `json:",omitempty"`
+}
+
+// Returns a one line summary of the diff, for use in reports.
+func (d Diff) Summary() string {
+	if d.Error != "" {
+		return d.Source + " manifest FAILED"
+	}
+	return d.Source + " manifest MISSING(" + strconv.Itoa(len(d.Missing)) + ") EXTRA(" +
+		strconv.Itoa(len(d.Extra)) + ") MISMATCHED(" + strconv.Itoa(len(d.Mismatched)) + ")"
+}
+
+type ManifestPageVariables struct {
+	LocalServer bool
+	Error       string
+	Diffs       []Diff
+}
+
+// Shows the diff of every source with a manifest, or just the one selected by ?source=
+func ManifestPage(w http.ResponseWriter, r *http.Request) {
+	vars := ManifestPageVariables{
+		LocalServer: true,
+	}
+	var err error
+	vars.Diffs, err = GetDiffs(r.URL.Query().Get("source"))
+	if err != nil {
+		vars.Error = err.Error()
+	}
+	ManifestFetch(w, &vars)
+}
+
+// Writes the diff of the source (given by ?source=) as csv, for download.
+// Test:  curl -s 'http://localhost:8090/manifest.csv?source=Acer'
+func ManifestCsvPage(w http.ResponseWriter, r *http.Request) {
+	diffs, err := GetDiffs(r.URL.Query().Get("source"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=manifest.csv")
+	if err := WriteCsv(w, diffs...); err != nil {
+		log.Print("ERROR: ManifestCsvPage writing error: ", err)
+	}
+}
+
+// Writes the expanded html of the diffs to the parm.
+func ManifestFetch(w io.Writer, vars *ManifestPageVariables) error {
+	t, err := template.ParseFiles("manifest/manifest.html")
+	if err != nil {
+		log.Print("ERROR: ManifestFetch template parsing error: ", err)
+		return err
+	}
+	if err = t.Execute(w, vars); err != nil {
+		log.Print("ERROR: ManifestFetch template executing error: ", err)
+	}
+	return err
+}
+
+// Writes one line per difference: Source, Difference, Path, SourceSize, BackedUpSize
+func WriteCsv(w io.Writer, diffs ...Diff) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"Source", "Difference", "Path", "SourceSize", "BackedUpSize"})
+	size := func(n int64) string { return strconv.FormatInt(n, 10) }
+	for _, d := range diffs {
+		for _, f := range d.Missing {
+			writer.Write([]string{d.Source, "missing", f.Path, size(f.Size), ""})
+		}
+		for _, f := range d.Extra {
+			writer.Write([]string{d.Source, "extra", f.Path, "", size(f.Size)})
+		}
+		for _, m := range d.Mismatched {
+			writer.Write([]string{d.Source, m.Reason, m.Path, size(m.SourceSize), size(m.BackedUpSize)})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Returns the diff of each source that has a ManifestPath, or just the named source.
+// The folder of each source is only listed once.
+func GetDiffs(sourceName string) ([]Diff, error) {
+	c := config.Get()
+	var diffs []Diff
+	listings := map[string][]FileEntry{}
+	listingErrors := map[string]error{}
+	for _, source := range c.Sources {
+		if source.ManifestPath == "" || (sourceName != "" && source.Name != sourceName) {
+			continue
+		}
+		if _, ok := listings[source.FolderId]; !ok {
+			listings[source.FolderId], listingErrors[source.FolderId] = ListBackedUp(source.FolderId)
+		}
+		diffs = append(diffs, diff(source, listings[source.FolderId], listingErrors[source.FolderId]))
+	}
+	if sourceName != "" && len(diffs) == 0 {
+		return nil, errors.New("no source " + sourceName + " with a manifest")
+	}
+	return diffs, nil
+}
+
+func diff(source config.Source, backedUp []FileEntry, listErr error) Diff {
+	d := Diff{Source: source.Name, FolderId: source.FolderId, FolderName: source.FolderId, Time: time.Now().Format(config.TIME_FORMAT)}
+	folder, _ := config.Get().Folder(source.FolderId)
+	if folder.Id != "" {
+		d.FolderName = folder.Label()
+	}
+	manifest, err := ReadManifest(source.ManifestPath)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	if listErr != nil {
+		d.Error = listErr.Error()
+		return d
+	}
+	d.SourceFiles = len(manifest)
+	d.BackedUpFiles = len(backedUp)
+	local := map[string]FileEntry{}
+	for _, f := range backedUp {
+		local[f.Path] = f
+	}
+	inManifest := map[string]bool{}
+	for _, f := range manifest {
+		inManifest[f.Path] = true
+		b, ok := local[f.Path]
+		if !ok {
+			d.Missing = append(d.Missing, f)
+		} else if b.Size != f.Size {
+			d.Mismatched = append(d.Mismatched, Mismatch{Path: f.Path, Reason: "size", SourceSize: f.Size, BackedUpSize: b.Size})
+		} else if f.Hash != "" && folder.LocalPath != "" {
+			hash, err := hashFile(filepath.Join(folder.LocalPath, filepath.FromSlash(f.Path)))
+			if err != nil {
+				log.Printf("ERROR: manifest hashing %s: %s\n", f.Path, err)
+			} else if !strings.EqualFold(hash, f.Hash) {
+				d.Mismatched = append(d.Mismatched, Mismatch{Path: f.Path, Reason: "hash", SourceSize: f.Size, BackedUpSize: b.Size})
+			}
+		}
+	}
+	for _, b := range backedUp {
+		if !inManifest[b.Path] {
+			d.Extra = append(d.Extra, b)
+		}
+	}
+	return d
+}
+
+// Reads the manifest at the path, skipping blank lines. Paths are cleaned, and windows
+// separators converted, so that they compare with the backed up paths.
+func ReadManifest(path string) ([]FileEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("ERROR: opening for read %s: %s\n", path, err)
+		return nil, err
+	}
+	defer file.Close()
+	var entries []FileEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entry := FileEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("ERROR: parsing manifest %s line %s: %s\n", path, line, err)
+			return nil, err
+		}
+		entry.Path = cleanPath(entry.Path)
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func cleanPath(path string) string {
+	path = strings.Replace(path, `\`, "/", -1)
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+}
+
+func sortEntries(entries []FileEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+}
+
+// Lists the files backed up in the folder, by walking its LocalPath if set, otherwise
+// using the syncthing api. Directories are not included.
+func ListBackedUp(folderId string) ([]FileEntry, error) {
+	folder, ok := config.Get().Folder(folderId)
+	if !ok {
+		return nil, errors.New("not one of the monitored folders: " + folderId)
+	}
+	var entries []FileEntry
+	var err error
+	if folder.LocalPath != "" {
+		entries, err = walk(folder.LocalPath)
+	} else {
+		entries, err = browse(folderId)
+	}
+	if err != nil {
+		log.Printf("ERROR: listing folder %s: %s\n", folderId, err)
+		return nil, err
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// Syncthing's own files are not part of the backup.
+func ignored(name string) bool {
+	return name == ".stfolder" || name == ".stignore" || name == ".stversions" || strings.HasPrefix(name, ".syncthing.")
+}
+
+func walk(root string) ([]FileEntry, error) {
+	var entries []FileEntry
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ignored(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, FileEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime().Format(time.RFC3339),
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// An entry of the tree returned by /rest/db/browse (syncthing v1.x).
+type browseEntry struct {
+	Name     string
+	ModTime  string
+	Size     int64
+	Type     string // eg FILE_INFO_TYPE_FILE, FILE_INFO_TYPE_DIRECTORY
+	Children []browseEntry
+}
+
+func browse(folderId string) ([]FileEntry, error) {
+	endpoint, err := status.SyncthingUrl(BROWSE_PATH, url.Values{"folder": {folderId}})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-API-Key", config.Get().SyncApiKey)
+	response, err := (&http.Client{Timeout: 5 * time.Minute}).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("syncthing browse: " + response.Status)
+	}
+	var tree []browseEntry
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	var entries []FileEntry
+	flatten("", tree, &entries)
+	return entries, nil
+}
+
+func flatten(prefix string, tree []browseEntry, entries *[]FileEntry) {
+	for _, e := range tree {
+		if ignored(e.Name) {
+			continue
+		}
+		path := prefix + e.Name
+		if e.Type == "FILE_INFO_TYPE_DIRECTORY" || len(e.Children) > 0 {
+			flatten(path+"/", e.Children, entries)
+		} else if e.Type == "" || e.Type == "FILE_INFO_TYPE_FILE" {
+			*entries = append(*entries, FileEntry{Path: path, Size: e.Size, ModTime: e.ModTime})
+		}
+	}
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
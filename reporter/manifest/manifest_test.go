@@ -0,0 +1,119 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reporter/config"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"docs/a.txt", "docs/a.txt"},
+		{"/docs/a.txt", "docs/a.txt"},
+		{`docs\sub\a.txt`, "docs/sub/a.txt"},
+		{"./docs//a.txt", "docs/a.txt"},
+		{"docs/../a.txt", "a.txt"},
+		{"../../a.txt", "a.txt"}, // Not above the folder root
+	}
+	for _, test := range tests {
+		if got := cleanPath(test.path); got != test.want {
+			t.Errorf("cleanPath(%q): got %q, expected %q", test.path, got, test.want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The manifest is compared with the files found by walking the folder's LocalPath.
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "folder")
+	configPath := filepath.Join(dir, "config.json")
+	writeFile(t, configPath, fmt.Sprintf(`{"ConfigVersion": %d, "Port": "8090",
+		"SyncApiEndpoint": "http://localhost:8384/rest/db/status",
+		"SyncFolders": [{"Id": "f1", "Name": "Docs", "LocalPath": %q}]}`, config.CONFIG_VERSION, local))
+	config.Path(configPath)
+
+	writeFile(t, filepath.Join(local, "same.txt"), "same")
+	writeFile(t, filepath.Join(local, "docs", "hashed.txt"), "hashed")
+	writeFile(t, filepath.Join(local, "docs", "changed.txt"), "backed up")
+	writeFile(t, filepath.Join(local, "short.txt"), "abc")
+	writeFile(t, filepath.Join(local, "extra.txt"), "extra")
+	writeFile(t, filepath.Join(local, ".stfolder", "x"), "")
+	writeFile(t, filepath.Join(local, ".stignore"), "")
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	writeFile(t, manifestPath, `{"Path": "same.txt", "Size": 4}
+{"Path": "docs\\hashed.txt", "Size": 6, "Hash": "`+hash("hashed")+`"}
+
+{"Path": "docs/changed.txt", "Size": 9, "Hash": "`+hash("at source")+`"}
+{"Path": "/short.txt", "Size": 10}
+{"Path": "missing.txt", "Size": 7}
+`)
+
+	backedUp, err := walk(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := diff(config.Source{Name: "Acer", FolderId: "f1", ManifestPath: manifestPath}, backedUp, nil)
+	if d.Error != "" {
+		t.Fatal(d.Error)
+	}
+	if d.FolderName != "Docs" || d.SourceFiles != 5 || d.BackedUpFiles != 5 {
+		t.Errorf("FolderName %s, SourceFiles %d, BackedUpFiles %d; expected Docs, 5, 5", d.FolderName, d.SourceFiles, d.BackedUpFiles)
+	}
+	if len(d.Missing) != 1 || d.Missing[0].Path != "missing.txt" {
+		t.Errorf("Missing %v, expected missing.txt", d.Missing)
+	}
+	if len(d.Extra) != 1 || d.Extra[0].Path != "extra.txt" {
+		t.Errorf("Extra %v, expected extra.txt", d.Extra)
+	}
+	wantMismatched := []Mismatch{
+		{Path: "docs/changed.txt", Reason: "hash", SourceSize: 9, BackedUpSize: 9},
+		{Path: "short.txt", Reason: "size", SourceSize: 10, BackedUpSize: 3},
+	}
+	if fmt.Sprint(d.Mismatched) != fmt.Sprint(wantMismatched) {
+		t.Errorf("Mismatched %v, expected %v", d.Mismatched, wantMismatched)
+	}
+	if got, want := d.Summary(), "Acer manifest MISSING(1) EXTRA(1) MISMATCHED(2)"; got != want {
+		t.Errorf("Summary %q, expected %q", got, want)
+	}
+
+	// A manifest that can't be read, or a folder that can't be listed, fails the diff.
+	d = diff(config.Source{Name: "Acer", FolderId: "f1", ManifestPath: filepath.Join(dir, "none.json")}, backedUp, nil)
+	if d.Error == "" || d.Summary() != "Acer manifest FAILED" {
+		t.Errorf("no manifest: Error %q, Summary %q", d.Error, d.Summary())
+	}
+	d = diff(config.Source{Name: "Acer", FolderId: "f1", ManifestPath: manifestPath}, nil, fmt.Errorf("unreachable"))
+	if d.Error != "unreachable" {
+		t.Errorf("unlisted folder: Error %q", d.Error)
+	}
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	writeFile(t, path, `{"Path": "a.txt", "Size": 1}
+{"Path": "b.txt", "Size": "big"}
+`)
+	if entries, err := ReadManifest(path); err == nil {
+		t.Errorf("got %v, expected an error", entries)
+	}
+}
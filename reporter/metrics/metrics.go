@@ -0,0 +1,156 @@
+package metrics
+
+// Serves the backup health in the prometheus text exposition format, for scraping.
+// Ref: https://prometheus.io/docs/instrumenting/exposition_formats/
+// Test:  curl -s http://localhost:8090/metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reporter/alert"
+	"reporter/config"
+	"reporter/notify"
+	"reporter/outbox"
+	"reporter/status"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PREFIX = "syncbox_" // Of every metric name
+)
+
+// The folder states reported by syncthing; the current one is 1 and the others 0.
+var folderStates = []string{
+	"idle", "scanning", "scan-waiting", "sync-waiting", "sync-preparing",
+	"syncing", "cleaning", "clean-waiting", "error", "unknown",
+}
+
+// Accumulates the samples of each metric, so that they are written grouped under
+// their HELP and TYPE lines.
+type exposition struct {
+	names   []string
+	help    map[string]string
+	kind    map[string]string
+	samples map[string][]string
+}
+
+func newExposition() *exposition {
+	return &exposition{
+		help:    map[string]string{},
+		kind:    map[string]string{},
+		samples: map[string][]string{},
+	}
+}
+
+// Adds a sample; labels are given as name, value pairs.
+func (e *exposition) add(name, kind, help string, value float64, labels ...string) {
+	name = PREFIX + name
+	if _, ok := e.help[name]; !ok {
+		e.names = append(e.names, name)
+		e.help[name] = help
+		e.kind[name] = kind
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escape(labels[i+1])+`"`)
+	}
+	sample := name
+	if len(pairs) > 0 {
+		sample = sample + "{" + strings.Join(pairs, ",") + "}"
+	}
+	e.samples[name] = append(e.samples[name], sample+" "+strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (e *exposition) gauge(name, help string, value float64, labels ...string) {
+	e.add(name, "gauge", help, value, labels...)
+}
+
+func (e *exposition) counter(name, help string, value float64, labels ...string) {
+	e.add(name, "counter", help, value, labels...)
+}
+
+func (e *exposition) write(buffer *bytes.Buffer) {
+	for _, name := range e.names {
+		fmt.Fprintf(buffer, "# HELP %s %s\n", name, e.help[name])
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", name, e.kind[name])
+		for _, sample := range e.samples[name] {
+			buffer.WriteString(sample + "\n")
+		}
+	}
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func MetricsPage(w http.ResponseWriter, r *http.Request) {
+	var buffer bytes.Buffer
+	collect().write(&buffer)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
+
+func collect() *exposition {
+	e := newExposition()
+	statuses := status.Latest().Statuses
+	folders := map[string]*status.SyncthingStatus{}
+	for _, s := range statuses {
+		labels := []string{"source", s.Source, "folder", s.FolderId}
+		up := 0.0
+		if s.Error == "" {
+			up = 1
+			e.gauge("missing_files", "Files on the source that are not backed up.", float64(s.MissingFiles), labels...)
+			e.gauge("missing_bytes", "Bytes on the source that are not backed up.", float64(s.MissingBytes), labels...)
+			e.gauge("backed_up_files", "Files in the local copy of the folder.", float64(s.BackedUpFiles), labels...)
+			e.gauge("backed_up_bytes", "Bytes in the local copy of the folder.", float64(s.BackedUpBytes), labels...)
+			e.gauge("source_files", "Files on the source, from its status file.", float64(s.SourceFiles), labels...)
+			e.gauge("source_bytes", "Bytes on the source, from its status file.", float64(s.SourceBytes), labels...)
+			if age, err := config.ParseAge(s.SourceAge); err == nil {
+				e.gauge("source_age_seconds", "Age of the source's status file.", age.Seconds(), labels...)
+			}
+		}
+		e.gauge("status_up", "1 if the source's status was fully fetched, else 0.", up, labels...)
+		if s.Syncthing != nil {
+			folders[s.FolderId] = s.Syncthing
+		}
+	}
+	var folderIds []string
+	for folderId := range folders {
+		folderIds = append(folderIds, folderId)
+	}
+	sort.Strings(folderIds)
+	for _, folderId := range folderIds {
+		st := folders[folderId]
+		e.gauge("syncthing_need_files", "Files that syncthing still needs to fetch.", float64(st.NeedFiles), "folder", folderId)
+		e.gauge("syncthing_need_bytes", "Bytes that syncthing still needs to fetch.", float64(st.NeedBytes), "folder", folderId)
+		e.gauge("syncthing_pull_errors", "Files that syncthing failed to fetch.", float64(st.PullErrors), "folder", folderId)
+		e.gauge("syncthing_errors", "Errors reported by syncthing for the folder.", float64(st.Errors), "folder", folderId)
+		e.gauge("syncthing_global_bytes", "Bytes in the global (cluster) copy of the folder.", float64(st.GlobalBytes), "folder", folderId)
+		e.gauge("syncthing_local_bytes", "Bytes in the local copy of the folder.", float64(st.LocalBytes), "folder", folderId)
+		known := false
+		for _, state := range folderStates {
+			value := 0.0
+			if st.State == state {
+				value = 1
+				known = true
+			}
+			e.gauge("syncthing_folder_state", "1 for the current state of the folder, else 0.", value, "folder", folderId, "state", state)
+		}
+		if !known && st.State != "" {
+			e.gauge("syncthing_folder_state", "1 for the current state of the folder, else 0.", 1, "folder", folderId, "state", st.State)
+		}
+	}
+	e.gauge("alerts_active", "Alerts currently active.", float64(len(alert.Active())))
+	e.counter("syncthing_scrape_errors_total", "Failed calls to the syncthing api.", float64(status.ScrapeErrors()))
+	for _, c := range notify.SendCounts() {
+		e.counter("notifications_sent_total", "Reports sent successfully.", float64(c.Sent), "report", c.Report, "channel", c.Channel)
+		e.counter("notifications_failed_total", "Reports that failed to send.", float64(c.Failures), "report", c.Report, "channel", c.Channel)
+	}
+	e.gauge("outbox_entries", "Reports queued in the outbox, waiting to be sent.", float64(len(outbox.Entries())))
+	return e
+}
@@ -0,0 +1,53 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reporter/config"
+	"sync/atomic"
+	"time"
+)
+
+// Writes each report as an email file into a local maildir, where it can be read
+// by any mail client (or just browsed) on the box.
+// Ref: https://cr.yp.to/proto/maildir.html
+type MaildirNotifier struct {
+	name string
+	path string
+}
+
+var deliveries int64 // Makes file names unique within this process
+
+func (n *MaildirNotifier) Name() string {
+	return n.name
+}
+
+// The message is written to tmp/ and then moved into new/ so that a reader
+// never sees a partial file.
+func (n *MaildirNotifier) Send(msg *Message) error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(n.path, dir), 0700); err != nil {
+			return err
+		}
+	}
+	hostname, _ := os.Hostname()
+	unique := fmt.Sprintf("%d.P%dQ%d.%s", time.Now().Unix(), os.Getpid(), atomic.AddInt64(&deliveries, 1), hostname)
+	tmpPath := filepath.Join(n.path, "tmp", unique)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	m := newMessage(config.Get(), msg)
+	if _, err = m.WriteTo(file); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(n.path, "new", unique))
+}
@@ -0,0 +1,194 @@
+package notify
+
+// Delivery of the generated reports over the configured channels (see config.Notifiers).
+// Each report is generated once as html, and each channel sends either the html or
+// a plain text rendering of it, depending on what it can show.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"reporter/config"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TYPE_SMTP    = "smtp"    // Email, using the Email* config
+	TYPE_WEBHOOK = "webhook" // JSON POST of the message to the Url
+	TYPE_NTFY    = "ntfy"    // Push using ntfy; the Url includes the topic
+	TYPE_GOTIFY  = "gotify"  // Push using a gotify server at the Url
+	TYPE_MAILDIR = "maildir" // Each message is written as a file in the maildir at Path
+)
+
+var Types = []string{TYPE_SMTP, TYPE_WEBHOOK, TYPE_NTFY, TYPE_GOTIFY, TYPE_MAILDIR}
+
+// A generated report, ready for sending.
+type Message struct {
+	Key         string // Name of the report (see config.KeyName)
+	Subject     string
+	Html        string
+	Attachments []Attachment // Sent by the channels that can (smtp, maildir, webhook)
+}
+
+// A file sent with a report, eg the csv of a manifest diff.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Returns a plain text rendering of the html, for channels that cannot show html.
+func (m *Message) Text() string {
+	return HtmlToText(m.Html)
+}
+
+type Notifier interface {
+	Name() string
+	Send(msg *Message) error
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Returns the notifiers that the report (with the key name) is to be sent to. If no
+// Notifiers are configured, then all reports are emailed, as before there were channels.
+func ForReport(c config.Configuration, keyName string) []Notifier {
+	if len(c.Notifiers) == 0 {
+		return []Notifier{&SmtpNotifier{name: TYPE_SMTP}}
+	}
+	var notifiers []Notifier
+	for _, nc := range c.Notifiers {
+		if !nc.Handles(keyName) {
+			continue
+		}
+		if notifier, err := New(nc); err != nil {
+			log.Printf("ERROR: notifier %s: %s\n", nc.Name, err)
+		} else {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+	return notifiers
+}
+
+// Creates a notifier of the configured type.
+func New(nc config.NotifierConfig) (Notifier, error) {
+	switch nc.Type {
+	case TYPE_SMTP:
+		return &SmtpNotifier{name: nc.Name}, nil
+	case TYPE_WEBHOOK:
+		return &WebhookNotifier{name: nc.Name, url: nc.Url}, nil
+	case TYPE_NTFY:
+		return &NtfyNotifier{name: nc.Name, url: nc.Url, token: nc.Token}, nil
+	case TYPE_GOTIFY:
+		return &GotifyNotifier{name: nc.Name, url: nc.Url, token: nc.Token}, nil
+	case TYPE_MAILDIR:
+		return &MaildirNotifier{name: nc.Name, path: nc.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type '%s'", nc.Type)
+}
+
+// Sends the message over the notifier, logging and counting the outcome. The reports are
+// queued in the outbox, which calls this for each channel (see the outbox package).
+func Send(tag string, notifier Notifier, msg *Message) error {
+	err := notifier.Send(msg)
+	count(msg.Key, notifier.Name(), err)
+	if err != nil {
+		log.Printf("ERROR: %s: notifier %s error: %v\n", tag, notifier.Name(), err)
+	} else {
+		log.Printf("%s: notified %s OK\n", tag, notifier.Name())
+	}
+	return err
+}
+
+// The number of sends (and failures) for a report over a channel, since starting.
+type SendCount struct {
+	Report   string
+	Channel  string
+	Sent     int64
+	Failures int64
+}
+
+var sendCounts = map[string]*SendCount{} // Keyed by report and channel
+var countsMutex = &sync.Mutex{}
+
+func count(report, channel string, err error) {
+	countsMutex.Lock()
+	defer countsMutex.Unlock()
+	key := report + "/" + channel
+	c, ok := sendCounts[key]
+	if !ok {
+		c = &SendCount{Report: report, Channel: channel}
+		sendCounts[key] = c
+	}
+	if err != nil {
+		c.Failures++
+	} else {
+		c.Sent++
+	}
+}
+
+// Returns a copy of the send counts, ordered by report then channel.
+func SendCounts() []SendCount {
+	countsMutex.Lock()
+	defer countsMutex.Unlock()
+	var counts []SendCount
+	for _, c := range sendCounts {
+		counts = append(counts, *c)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Report != counts[j].Report {
+			return counts[i].Report < counts[j].Report
+		}
+		return counts[i].Channel < counts[j].Channel
+	})
+	return counts
+}
+
+var (
+	reBreak   = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</tr>|<h[1-6][^>]*>|</h[1-6]>|</li>|</table>`)
+	reCell    = regexp.MustCompile(`(?i)</t[dh]>`)
+	reHead    = regexp.MustCompile(`(?is)<(head|style|script)[^>]*>.*?</(head|style|script)>`)
+	reTag     = regexp.MustCompile(`(?s)<[^>]*>`)
+	reSpaces  = regexp.MustCompile(`[ \t]+`)
+	reNewline = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// A simple rendering of the report html as plain text; rows and paragraphs become
+// lines, table cells are separated by spaces, and everything else is dropped.
+func HtmlToText(h string) string {
+	t := reHead.ReplaceAllString(h, "")
+	t = strings.Replace(t, "\n", " ", -1)
+	t = reBreak.ReplaceAllString(t, "\n")
+	t = reCell.ReplaceAllString(t, " ")
+	t = reTag.ReplaceAllString(t, "")
+	t = html.UnescapeString(t)
+	t = reSpaces.ReplaceAllString(t, " ")
+	var lines []string
+	for _, line := range strings.Split(t, "\n") {
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	t = strings.Join(lines, "\n")
+	t = reNewline.ReplaceAllString(t, "\n")
+	return strings.TrimSpace(t) + "\n"
+}
+
+// Truncates the text to at most max bytes, for channels with a size limit.
+func truncate(text string, max int) string {
+	const more = "\n..."
+	if len(text) <= max {
+		return text
+	}
+	var buffer bytes.Buffer
+	for _, r := range text {
+		if buffer.Len()+len(string(r))+len(more) > max {
+			break
+		}
+		buffer.WriteRune(r)
+	}
+	return buffer.String() + more
+}
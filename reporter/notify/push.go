@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	PUSH_MAX_BYTES = 4000 // ntfy sends larger messages as attachments, so keep below its 4096 limit
+)
+
+// Pushes the plain text report to an ntfy topic; the url is like https://ntfy.sh/mytopic
+// Ref: https://docs.ntfy.sh/publish/
+type NtfyNotifier struct {
+	name  string
+	url   string
+	token string // Optional access token
+}
+
+func (n *NtfyNotifier) Name() string {
+	return n.name
+}
+
+func (n *NtfyNotifier) Send(msg *Message) error {
+	text := truncate(msg.Text(), PUSH_MAX_BYTES)
+	request, err := http.NewRequest(http.MethodPost, n.url, strings.NewReader(text))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Title", msg.Subject)
+	request.Header.Set("Tags", strings.ToLower(msg.Key))
+	if n.token != "" {
+		request.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return do(request)
+}
+
+// Pushes the plain text report to a gotify server; the url is the server root.
+// Ref: https://gotify.net/docs/pushmsg
+type GotifyNotifier struct {
+	name  string
+	url   string
+	token string // The application token
+}
+
+type gotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+func (n *GotifyNotifier) Name() string {
+	return n.name
+}
+
+func (n *GotifyNotifier) Send(msg *Message) error {
+	payload, err := json.Marshal(gotifyMessage{
+		Title:    msg.Subject,
+		Message:  truncate(msg.Text(), PUSH_MAX_BYTES),
+		Priority: 5,
+	})
+	if err != nil {
+		return err
+	}
+	url := strings.TrimRight(n.url, "/") + "/message"
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gotify-Key", n.token)
+	return do(request)
+}
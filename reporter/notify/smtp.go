@@ -0,0 +1,253 @@
+package notify
+
+// ref: https://stackoverflow.com/questions/2591755/how-to-send-html-email-using-linux-command-line
+// Ref: https://github.com/go-gomail/gomail and https://godoc.org/gopkg.in/gomail.v2 seems to be the go hah
+// Ref: https://gist.github.com/chrisgillis/10888032  has useful info
+
+// The connection is made with net/smtp (rather than the gomail Dialer, which always
+// upgrades to tls when offered and only knows PLAIN and CRAM-MD5) so that the port, the
+// tls mode (implicit, starttls or none) and the auth mechanism follow the Email* config.
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gopkg.in/gomail.v2"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"reporter/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SMTP_TIMEOUT    = time.Minute // For connecting, and then for the whole session
+	SMTP_LOCAL_NAME = "localhost" // Sent in the EHLO
+)
+
+// Emails the html report, using the Email* config.
+type SmtpNotifier struct {
+	name string
+}
+
+func (n *SmtpNotifier) Name() string {
+	return n.name
+}
+
+func (n *SmtpNotifier) Send(msg *Message) error {
+	c := config.Get()
+	if to, cc, bcc := c.Addressees(msg.Key); len(to)+len(cc)+len(bcc) == 0 {
+		return errors.New("no Recipients for the " + msg.Key + " report")
+	}
+	m := newMessage(c, msg)
+	client, err := dialSmtp(c, nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err = gomail.Send(&smtpSender{client}, m); err != nil {
+		return err
+	}
+	// The mail was accepted, so a failure to quit cleanly mustn't have it sent again.
+	if err = client.Quit(); err != nil {
+		log.Printf("ERROR: %s: quitting after the %s report was sent: %s\n", n.name, msg.Key, err)
+	}
+	return nil
+}
+
+// Sends the messages of gomail over a connected client.
+type smtpSender struct {
+	client *smtp.Client
+}
+
+func (s *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
+	if err := s.client.Mail(from); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := s.client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	w, err := s.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Connects to the EmailHost, and then (as configured) upgrades to tls and authenticates.
+// Each step is appended to the steps (if not nil), for the settings page's connection test.
+func dialSmtp(c config.Configuration, steps *[]string) (*smtp.Client, error) {
+	note := func(format string, a ...interface{}) {
+		if steps != nil {
+			*steps = append(*steps, fmt.Sprintf(format, a...))
+		}
+	}
+	if c.EmailHost == "" {
+		return nil, errors.New("no EmailHost")
+	}
+	port, tlsMode, auth := c.EmailTransport()
+	addr := net.JoinHostPort(c.EmailHost, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, SMTP_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+	note("connected to %s", addr)
+	tlsConfig := &tls.Config{ServerName: c.EmailHost}
+	if tlsMode == config.EMAIL_TLS_IMPLICIT {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with %s: %v", addr, err)
+		}
+		note("tls: %s", describeTls(tlsConn.ConnectionState()))
+		conn = tlsConn
+	}
+	client, err := smtp.NewClient(conn, c.EmailHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = client.Hello(SMTP_LOCAL_NAME); err != nil {
+		client.Close()
+		return nil, err
+	}
+	note("server extensions: %s", describeExtensions(client))
+	if tlsMode == config.EMAIL_TLS_STARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("the server does not offer STARTTLS")
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("STARTTLS: %v", err)
+		}
+		state, _ := client.TLSConnectionState()
+		note("starttls: %s", describeTls(state))
+	}
+	if auth == config.EMAIL_AUTH_NONE {
+		note("auth: none")
+		return client, nil
+	}
+	var a smtp.Auth
+	switch auth {
+	case config.EMAIL_AUTH_LOGIN:
+		a = &loginAuth{c.EmailUserName, c.EmailPassword, c.EmailHost}
+	case config.EMAIL_AUTH_CRAM_MD5:
+		a = smtp.CRAMMD5Auth(c.EmailUserName, c.EmailPassword)
+	default:
+		a = smtp.PlainAuth("", c.EmailUserName, c.EmailPassword, c.EmailHost)
+	}
+	if err = client.Auth(a); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("%s auth as %s: %v", auth, c.EmailUserName, err)
+	}
+	note("auth: %s as %s accepted", auth, c.EmailUserName)
+	return client, nil
+}
+
+// Connects and authenticates as for sending, but quits without sending any mail. Returns
+// the steps taken and the server's responses, ending with the failure if there was one.
+func TestSmtp(c config.Configuration) ([]string, error) {
+	var steps []string
+	client, err := dialSmtp(c, &steps)
+	if err != nil {
+		return append(steps, "failed: "+err.Error()), err
+	}
+	defer client.Close()
+	if err = client.Quit(); err != nil {
+		return append(steps, "failed: "+err.Error()), err
+	}
+	return append(steps, "ok (no mail was sent)"), nil
+}
+
+func describeTls(state tls.ConnectionState) string {
+	s := tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		name := cert.Subject.CommonName
+		if name == "" && len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+		s += ", certificate for " + name + " expires " + cert.NotAfter.Format("2006-01-02")
+	}
+	return s
+}
+
+// Lists the extensions of interest that the server offered in its EHLO response.
+func describeExtensions(client *smtp.Client) string {
+	var offered []string
+	for _, ext := range []string{"STARTTLS", "AUTH", "SIZE", "8BITMIME", "SMTPUTF8"} {
+		if ok, param := client.Extension(ext); ok {
+			offered = append(offered, strings.TrimSpace(ext+" "+param))
+		}
+	}
+	if len(offered) == 0 {
+		return "none"
+	}
+	return strings.Join(offered, ", ")
+}
+
+// The LOGIN mechanism (which net/smtp lacks); like PlainAuth, the password is only sent
+// over tls or to localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !config.IsLocalHost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// Creates an email for the report, from the EmailFrom to its Recipients.
+func newMessage(c config.Configuration, msg *Message) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", c.EmailFrom)
+	to, cc, bcc := c.Addressees(msg.Key)
+	for header, addresses := range map[string][]string{"To": to, "Cc": cc, "Bcc": bcc} {
+		if len(addresses) > 0 {
+			m.SetHeader(header, addresses...) // gomail sends to the Bcc without writing its header
+		}
+	}
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.Text())
+	m.AddAlternative("text/html", msg.Html)
+	for _, a := range msg.Attachments {
+		data := a.Data // For capture by the copy func
+		m.Attach(a.Name,
+			gomail.SetHeader(map[string][]string{"Content-Type": {a.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}))
+	}
+	return m
+}
@@ -0,0 +1,67 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Posts the report as a json object to the url.
+type WebhookNotifier struct {
+	name string
+	url  string
+}
+
+// The json posted by the WebhookNotifier.
+type WebhookPayload struct {
+	Key     string
+	Subject string
+	Text    string
+	Html    string
+	Time    string
+
+	Attachments []Attachment `json:",omitempty"` // The Data of each is base64 encoded
+}
+
+func (n *WebhookNotifier) Name() string {
+	return n.name
+}
+
+func (n *WebhookNotifier) Send(msg *Message) error {
+	payload, err := json.Marshal(WebhookPayload{
+		Key:     msg.Key,
+		Subject: msg.Subject,
+		Text:    msg.Text(),
+		Html:    msg.Html,
+		Time:    time.Now().Format(time.RFC3339),
+
+		Attachments: msg.Attachments,
+	})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return do(request)
+}
+
+// Performs the request, treating any non 2xx response as an error.
+func do(request *http.Request) error {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s: %s", response.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package outbox
+
+// Generated reports are not sent directly, but queued in the outbox (one entry for each
+// channel the report goes to), which is kept in a json file at OutboxPath [outbox.json
+// beside the config] so that it survives restarts. The Sender sends each entry when it is
+// due; a failure (eg while the wifi is down) is retried after a backoff that doubles from
+// RETRY_MIN to RETRY_MAX, until the entry is older than OutboxExpiryHours [24], when it is
+// dropped. The outbox page lists the entries, and each can be retried now or deleted.
+// An outbox file that can't be read is moved aside (to <path>.bad-<time>), not overwritten.
+// Test:  curl -s http://localhost:8090/outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reporter/auth"
+	"reporter/config"
+	"reporter/notify"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RETRY_MIN            = time.Minute
+	RETRY_MAX            = time.Hour
+	DEFAULT_EXPIRY_HOURS = 24
+)
+
+// A report waiting to be sent over a channel.
+type Entry struct {
+	Id        string
+	Channel   string // The Name of the notifier
+	Message   notify.Message
+	Created   time.Time
+	Attempts  int
+	NextTry   time.Time
+	LastError string
+}
+
+var entries []Entry
+var loaded bool
+var unreadable bool // The outbox file couldn't be read or moved aside, so isn't overwritten
+var lastId int64
+var entriesMutex = &sync.Mutex{}
+
+// Wakes the Sender when entries are added or retried (buffered, so never blocks).
+var wake = make(chan bool, 1)
+
+// Returns the path of the outbox file.
+func Path(c config.Configuration) string {
+	if c.OutboxPath != "" {
+		return c.OutboxPath
+	}
+	return config.Beside("outbox.json")
+}
+
+func expiry(c config.Configuration) time.Duration {
+	hours := c.OutboxExpiryHours
+	if hours <= 0 {
+		hours = DEFAULT_EXPIRY_HOURS
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// Queues the message for each of the channels of its report, and wakes the Sender.
+func Dispatch(tag string, msg *notify.Message) {
+	notifiers := notify.ForReport(config.Get(), msg.Key)
+	if len(notifiers) == 0 {
+		log.Printf("%s: no channels for the %s report\n", tag, msg.Key)
+		return
+	}
+	entriesMutex.Lock()
+	load()
+	now := time.Now()
+	for _, notifier := range notifiers {
+		entries = append(entries, Entry{
+			Id: newId(now), Channel: notifier.Name(), Message: *msg, Created: now, NextTry: now,
+		})
+		log.Printf("%s: queued for %s\n", tag, notifier.Name())
+	}
+	save()
+	entriesMutex.Unlock()
+	signal()
+}
+
+// Returns a copy of the entries, oldest first.
+func Entries() []Entry {
+	entriesMutex.Lock()
+	defer entriesMutex.Unlock()
+	load()
+	return append([]Entry(nil), entries...)
+}
+
+// Makes the entry due now.
+func Retry(id string) error {
+	entriesMutex.Lock()
+	defer entriesMutex.Unlock()
+	load()
+	for i := range entries {
+		if entries[i].Id == id {
+			entries[i].NextTry = time.Now()
+			save()
+			signal()
+			return nil
+		}
+	}
+	return errors.New("no outbox entry " + id)
+}
+
+// Removes the entry, so that it is never sent.
+func Delete(id string) error {
+	entriesMutex.Lock()
+	defer entriesMutex.Unlock()
+	load()
+	if !remove(id) {
+		return errors.New("no outbox entry " + id)
+	}
+	save()
+	return nil
+}
+
+// Sends the entries as they become due, forever.
+func Sender() {
+	tag := "Sender(OUTBOX)"
+	log.Printf("%s: starting\n", tag)
+	for {
+		next := send(tag)
+		wait := time.Until(next)
+		if next.IsZero() {
+			wait = RETRY_MAX // Nothing queued; wait to be woken
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}
+}
+
+// Sends (or drops, if expired) each due entry, and returns when the next entry is due
+// (zero if there are none). The lock is not held while sending, which may be slow.
+func send(tag string) time.Time {
+	c := config.Get()
+	now := time.Now()
+	entriesMutex.Lock()
+	load()
+	var due, expired []Entry
+	for _, e := range entries {
+		if now.Sub(e.Created) > expiry(c) {
+			expired = append(expired, e)
+		} else if !e.NextTry.After(now) {
+			due = append(due, e)
+		}
+	}
+	for _, e := range expired {
+		log.Printf("ERROR: %s: dropped the %s report for %s, undelivered after %d attempts: %s\n",
+			tag, e.Message.Key, e.Channel, e.Attempts, e.LastError)
+		remove(e.Id)
+	}
+	if len(expired) > 0 {
+		save()
+	}
+	entriesMutex.Unlock()
+
+	for _, e := range due {
+		err := deliver(tag, c, &e)
+		entriesMutex.Lock()
+		if err == nil {
+			remove(e.Id)
+		} else {
+			for i := range entries {
+				if entries[i].Id == e.Id { // Unless deleted while sending
+					entries[i].Attempts++
+					entries[i].LastError = err.Error()
+					entries[i].NextTry = time.Now().Add(backoff(entries[i].Attempts))
+					log.Printf("%s: will retry the %s report for %s at %s\n", tag, e.Message.Key, e.Channel,
+						entries[i].NextTry.Format(config.TIME_FORMAT))
+				}
+			}
+		}
+		save()
+		entriesMutex.Unlock()
+	}
+
+	entriesMutex.Lock()
+	defer entriesMutex.Unlock()
+	var next time.Time
+	for _, e := range entries {
+		if next.IsZero() || e.NextTry.Before(next) {
+			next = e.NextTry
+		}
+	}
+	return next
+}
+
+// Sends the entry over its channel, as currently configured.
+func deliver(tag string, c config.Configuration, e *Entry) error {
+	for _, notifier := range notify.ForReport(c, e.Message.Key) {
+		if notifier.Name() == e.Channel {
+			return notify.Send(tag, notifier, &e.Message)
+		}
+	}
+	return fmt.Errorf("channel %s no longer sends the %s report", e.Channel, e.Message.Key)
+}
+
+// Returns the wait before the next attempt, doubling from RETRY_MIN up to RETRY_MAX.
+func backoff(attempts int) time.Duration {
+	wait := RETRY_MIN
+	for i := 1; i < attempts && wait < RETRY_MAX; i++ {
+		wait *= 2
+	}
+	if wait > RETRY_MAX {
+		wait = RETRY_MAX
+	}
+	return wait
+}
+
+func signal() {
+	select {
+	case wake <- true:
+	default: // Already woken
+	}
+}
+
+// Returns a unique id (with the lock held).
+func newId(now time.Time) string {
+	id := now.UnixNano()
+	if id <= lastId {
+		id = lastId + 1
+	}
+	lastId = id
+	return fmt.Sprintf("%x", id)
+}
+
+// Removes the entry (with the lock held), returning false if there is none.
+func remove(id string) bool {
+	for i := range entries {
+		if entries[i].Id == id {
+			entries = append(entries[:i], entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the outbox file (with the lock held), once; a missing file is an empty outbox.
+func load() {
+	if loaded {
+		return
+	}
+	loaded = true
+	path := Path(config.Get())
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(content, &entries)
+	}
+	if err != nil {
+		// Keep the file for inspection, rather than overwrite it with the next save.
+		log.Printf("ERROR: reading outbox %s: %s\n", path, err)
+		entries = nil
+		badPath := path + ".bad-" + time.Now().Format("20060102-150405")
+		if err := os.Rename(path, badPath); err != nil {
+			log.Printf("ERROR: moving aside outbox %s (it will not be saved): %s\n", path, err)
+			unreadable = true
+		} else {
+			log.Printf("outbox: the unreadable file is kept at %s\n", badPath)
+		}
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+	if len(entries) > 0 {
+		log.Printf("outbox: loaded %d unsent entries from %s\n", len(entries), path)
+	}
+}
+
+// Writes the outbox file (with the lock held).
+func save() {
+	path := Path(config.Get())
+	if unreadable {
+		log.Printf("ERROR: not writing outbox %s, which could not be read\n", path)
+		return
+	}
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		err = config.WriteFileAtomic(path, content, 0600)
+	}
+	if err != nil {
+		log.Printf("ERROR: writing outbox %s: %s\n", path, err)
+	}
+}
+
+type OutboxPageVariables struct {
+	LocalServer bool
+	Csrf        string // For the forms (see auth.CsrfToken)
+	Message     string // Any error/success message
+	Entries     []Entry
+	Expiry      string
+}
+
+// Lists the entries; a POST with an id and an action (retry or delete) acts on the entry.
+func OutboxPage(w http.ResponseWriter, r *http.Request) {
+	vars := OutboxPageVariables{LocalServer: true}
+	if r.Method == http.MethodPost {
+		id := r.PostFormValue("id")
+		var err error
+		switch r.PostFormValue("action") {
+		case "retry":
+			err = Retry(id)
+			vars.Message = "Retrying " + id
+		case "delete":
+			err = Delete(id)
+			vars.Message = "Deleted " + id
+		default:
+			err = errors.New("unknown action")
+		}
+		if err != nil {
+			vars.Message = "ERROR: " + err.Error()
+		}
+	}
+	vars.Csrf = auth.CsrfToken(r)
+	vars.Entries = Entries()
+	vars.Expiry = expiry(config.Get()).String()
+	t, err := template.ParseFiles("outbox/outbox.html")
+	if err != nil {
+		log.Print("ERROR: OutboxPage template parsing error: ", err)
+		return
+	}
+	if err = t.Execute(w, vars); err != nil {
+		log.Print("ERROR: OutboxPage template executing error: ", err)
+	}
+}
@@ -0,0 +1,156 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reporter/config"
+	"reporter/notify"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Uses a config with the notifiers (json) in a new directory, so the outbox file is beside
+// it, and forgets any loaded entries.
+func useTempConfig(t *testing.T, notifiers string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := fmt.Sprintf(`{"ConfigVersion": %d, "Port": "8090",
+		"SyncApiEndpoint": "http://localhost:8384/rest/db/status", "SyncFolders": [{"Id": "f1"}],
+		"Notifiers": %s}`, config.CONFIG_VERSION, notifiers)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Path(path)
+	entries, loaded, unreadable = nil, false, false
+	return Path(config.Get())
+}
+
+func TestCorruptOutbox(t *testing.T) {
+	path := useTempConfig(t, "[]")
+	corrupt := []byte(`[{"Id": "1", "Channel": "smtp"`)
+	if err := ioutil.WriteFile(path, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := Entries(); len(got) != 0 {
+		t.Errorf("entries %v, expected none", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s: %v, expected it moved aside", path, err)
+	}
+	bad, _ := filepath.Glob(path + ".bad-*")
+	if len(bad) != 1 {
+		t.Fatalf("moved aside to %v, expected one file", bad)
+	}
+	if content, err := ioutil.ReadFile(bad[0]); err != nil || string(content) != string(corrupt) {
+		t.Errorf("moved aside %q, %v; expected the corrupt content", content, err)
+	}
+
+	// New entries are saved afresh, leaving the unreadable file alone.
+	entriesMutex.Lock()
+	entries = append(entries, Entry{Id: "2", Channel: "smtp"})
+	save()
+	entriesMutex.Unlock()
+	var saved []Entry
+	if content, err := ioutil.ReadFile(path); err != nil {
+		t.Error(err)
+	} else if err := json.Unmarshal(content, &saved); err != nil || len(saved) != 1 || saved[0].Id != "2" {
+		t.Errorf("saved %s, %v; expected entry 2", content, err)
+	}
+	if content, _ := ioutil.ReadFile(bad[0]); string(content) != string(corrupt) {
+		t.Errorf("moved aside file changed to %q", content)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour}, // Not 64 minutes
+		{100, time.Hour},
+	}
+	for _, test := range tests {
+		if got := backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d): got %s, expected %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+// A report that fails is retried later (or now, if asked), surviving a restart, and is
+// dropped once it expires.
+func TestSendAndRetry(t *testing.T) {
+	var posts, failing int32 = 0, 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	useTempConfig(t, fmt.Sprintf(`[{"Name": "hook", "Type": "webhook", "Url": %q, "Reports": ["STATUS"]},
+		{"Name": "other", "Type": "webhook", "Url": %q, "Reports": ["HISTORY"]}]`, server.URL, server.URL))
+
+	Dispatch("test", &notify.Message{Key: "STATUS", Subject: "Status", Html: "<p>ok</p>"})
+	queued := Entries()
+	if len(queued) != 1 || queued[0].Channel != "hook" {
+		t.Fatalf("queued %+v, expected one entry for hook", queued)
+	}
+	before := time.Now()
+	next := send("test")
+	failed := Entries()
+	if len(failed) != 1 || failed[0].Attempts != 1 || !strings.Contains(failed[0].LastError, "500") {
+		t.Fatalf("after failing %+v, expected 1 attempt with the error", failed)
+	}
+	if wait := failed[0].NextTry.Sub(before); wait < RETRY_MIN || wait > RETRY_MIN+time.Minute {
+		t.Errorf("retrying after %s, expected %s", wait, RETRY_MIN)
+	}
+	if !next.Equal(failed[0].NextTry) {
+		t.Errorf("next %s, expected the NextTry %s", next, failed[0].NextTry)
+	}
+	send("test")
+	if n := atomic.LoadInt32(&posts); n != 1 {
+		t.Errorf("%d posts, expected no retry before the NextTry", n)
+	}
+
+	// Reloaded from the file, as after a restart.
+	entriesMutex.Lock()
+	entries, loaded = nil, false
+	entriesMutex.Unlock()
+	if reloaded := Entries(); len(reloaded) != 1 || reloaded[0].Id != failed[0].Id || reloaded[0].Attempts != 1 {
+		t.Fatalf("reloaded %+v, expected %+v", reloaded, failed)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	if err := Retry(failed[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if next := send("test"); !next.IsZero() || len(Entries()) != 0 {
+		t.Errorf("after sending, next %s and entries %+v; expected none", next, Entries())
+	}
+	if n := atomic.LoadInt32(&posts); n != 2 {
+		t.Errorf("%d posts, expected 2", n)
+	}
+	if Retry(failed[0].Id) == nil || Delete(failed[0].Id) == nil {
+		t.Error("sent entry: expected errors retrying or deleting it")
+	}
+
+	Dispatch("test", &notify.Message{Key: "STATUS", Subject: "Status", Html: "<p>late</p>"})
+	entriesMutex.Lock()
+	entries[0].Created = time.Now().Add(-DEFAULT_EXPIRY_HOURS*time.Hour - time.Minute)
+	entriesMutex.Unlock()
+	send("test")
+	if n := atomic.LoadInt32(&posts); n != 2 || len(Entries()) != 0 {
+		t.Errorf("expired entry: %d posts and entries %+v; expected it dropped unsent", n, Entries())
+	}
+}
@@ -3,25 +3,33 @@ package main
 import (
 	// "bufio"
 	"bytes"
+	"errors"
 	// "encoding/json"
 	"flag"
-	// "fmt"
+	"fmt"
 	"github.com/gorilla/mux"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"reporter/alert"
+	"reporter/api"
+	"reporter/auth"
 	// "fmt"
 	// "os/exec"
 	// "regexp"
 	"reporter/config"
 	"reporter/logging"
 	"reporter/mail"
+	"reporter/manifest"
+	"reporter/metrics"
+	"reporter/notify"
+	"reporter/outbox"
+	"reporter/server"
 	"reporter/settings"
 	"reporter/status"
-	// "strings"
-	"strconv"
+	"strings"
 	"time"
 )
 
@@ -30,10 +38,28 @@ const (
 )
 
 func main() {
-	// Only -config=cfgpath and -logfile=logpath are supported.
+	// Only -config=cfgpath, -logfile=logpath, -adduser=name:role and -check-config are supported.
 	logFilePath := flag.String("logfile", "", "path to log file")
 	configPath := flag.String("config", "config.json", "path to configuration file")
+	addUser := flag.String("adduser", "", "add or update the login name:role (viewer or admin), with the password from stdin, then exit")
+	checkConfig := flag.Bool("check-config", false, "report the problems of the config file, then exit (non-zero if any are errors)")
 	flag.Parse()
+	if *checkConfig {
+		problems := config.CheckFile(*configPath)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if config.HasErrors(problems) {
+			os.Exit(1)
+		}
+		fmt.Println("config OK: " + *configPath)
+		return
+	}
+	if *addUser != "" {
+		config.Path(*configPath)
+		CheckDie(auth.AddUser(*addUser, os.Stdin))
+		return
+	}
 	if *logFilePath != "" {
 		f, err := os.OpenFile(*logFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
 		CheckDie(err)
@@ -48,13 +74,30 @@ func main() {
 		config.KEY_REPORTER: make(chan config.ControlMsg),
 		config.KEY_SIMMON:   make(chan config.ControlMsg),
 		config.KEY_STATUS:   make(chan config.ControlMsg),
+		config.KEY_ALERT:    make(chan config.ControlMsg),
+		config.KEY_POLLER:   make(chan config.ControlMsg),
+		config.KEY_EVENTS:   make(chan config.ControlMsg),
 	}
 
+	// Reload the config when it is edited by hand
+	go config.Watch()
+
+	// Start the status poller, which the pages and mailers use
+	go status.Poller(config.MailerControl[config.KEY_POLLER], config.KEY_POLLER)
+	go status.EventSubscriber(config.MailerControl[config.KEY_EVENTS], config.KEY_EVENTS)
+
 	// Start the mailers
-	go mail.PeriodicMailer(config.MailerControl[config.KEY_HISTORY], config.KEY_HISTORY, makeGen(config.KEY_HISTORY))
-	go mail.PeriodicMailer(config.MailerControl[config.KEY_REPORTER], config.KEY_REPORTER, makeGen(config.KEY_REPORTER))
-	go mail.PeriodicMailer(config.MailerControl[config.KEY_SIMMON], config.KEY_SIMMON, makeGen(config.KEY_SIMMON))
-	go mail.WatcherMailer(config.MailerControl[config.KEY_STATUS], config.KEY_STATUS, makeGen(config.KEY_STATUS))
+	go mail.PeriodicMailer(config.MailerControl[config.KEY_HISTORY], config.KEY_HISTORY, makeGen(config.KEY_HISTORY, false))
+	go mail.PeriodicMailer(config.MailerControl[config.KEY_REPORTER], config.KEY_REPORTER, makeGen(config.KEY_REPORTER, false))
+	go mail.PeriodicMailer(config.MailerControl[config.KEY_SIMMON], config.KEY_SIMMON, makeGen(config.KEY_SIMMON, false))
+	go mail.WatcherMailer(config.MailerControl[config.KEY_STATUS], config.KEY_STATUS, makeGen(config.KEY_STATUS, false))
+	go mail.AlertMailer(config.MailerControl[config.KEY_ALERT], config.KEY_ALERT, makeGen(config.KEY_ALERT, false))
+	for _, key := range config.ReportKeys {
+		mail.PreviewGens[key] = makeGen(key, true)
+	}
+
+	// Start sending the reports that the mailers queue in the outbox
+	go outbox.Sender()
 
 	router := mux.NewRouter().StrictSlash(true)
 
@@ -65,14 +108,27 @@ func main() {
 	router.PathPrefix(STATIC_DIR).Handler(http.StripPrefix(STATIC_DIR, staticHandler))
 	// Test:  curl -s http://localhost:8090/static/test.txt
 
+	router.Use(auth.Middleware(STATIC_DIR))
+	router.HandleFunc("/login", auth.LoginPage).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/logout", auth.LogoutPage).Methods(http.MethodPost)
 	router.HandleFunc("/", HomePage)
+	router.HandleFunc("/refresh", RefreshPage).Methods(http.MethodPost)
 	router.HandleFunc("/history", status.HistoryPage)
+	router.HandleFunc("/history.csv", status.HistoryCsvPage)
+	router.HandleFunc("/history.json", status.HistoryJsonPage)
+	router.HandleFunc("/manifest", manifest.ManifestPage)
+	router.HandleFunc("/manifest.csv", manifest.ManifestCsvPage)
 	router.HandleFunc("/settings", settings.SettingsPage)
 	router.HandleFunc("/logging", logging.LoggingPage)
+	router.HandleFunc("/outbox", outbox.OutboxPage).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/metrics", metrics.MetricsPage)
+	router.HandleFunc("/preview/{report}", PreviewPage).Methods(http.MethodGet)
+	api.Register(router)
 
 	port := config.Get().Port
-	log.Printf("listening at: %s:%s\n", getOutboundIP(), port)
-	log.Fatal("FATAL: ", http.ListenAndServe(":"+port, router))
+	ip := getOutboundIP()
+	log.Printf("listening at: %s:%s\n", ip, port)
+	log.Fatal("FATAL: ", server.Serve(router, []string{ip.String()}))
 }
 
 func CheckDie(e error) {
@@ -84,7 +140,18 @@ func CheckDie(e error) {
 type HomePageVariables struct {
 	LocalServer bool
 	Error       string
-	Status      status.BackupStatus
+	Statuses    []status.BackupStatus // One per Source
+	PollTime    string                // When the Statuses were fetched
+	User        string                // Logged in, if authentication is enabled
+	Csrf        string                // For the forms (see auth.CsrfToken)
+}
+
+// Returns the display name of the folder, for the template.
+func (v HomePageVariables) FolderName(folderId string) string {
+	if folder, ok := config.Get().Folder(folderId); ok {
+		return folder.Label()
+	}
+	return folderId
 }
 
 func HomePage(w http.ResponseWriter, r *http.Request) {
@@ -99,12 +166,17 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 
 	homePageVars := HomePageVariables{
 		LocalServer: true,
+		Csrf:        auth.CsrfToken(r),
 	}
-	backupStatus, err := status.GetBackupStatus()
-	if err != nil {
-		homePageVars.Error = err.Error()
-	} else {
-		homePageVars.Status = *backupStatus
+	if session := auth.CurrentSession(r); session != nil {
+		homePageVars.User = session.User + " (" + session.Role + ")"
+	}
+	// Errors are shown against each folder's status.
+	snapshot := status.Latest()
+	homePageVars.Statuses = snapshot.Statuses
+	homePageVars.PollTime = snapshot.Time
+	if len(homePageVars.Statuses) == 0 {
+		homePageVars.Error = snapshot.Error
 	}
 	t, err := template.ParseFiles("home.html")
 	if err != nil {
@@ -115,6 +187,39 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Polls the sources now (rather than waiting for the poller), then shows the home page.
+func RefreshPage(w http.ResponseWriter, r *http.Request) {
+	status.Refresh()
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+type PreviewPageVariables struct {
+	LocalServer bool
+	Preview     mail.Preview
+}
+
+// Shows the report (eg /preview/HISTORY) exactly as it would be sent now, without sending it.
+func PreviewPage(w http.ResponseWriter, r *http.Request) {
+	key, ok := config.ReportKey(mux.Vars(r)["report"])
+	if !ok {
+		http.Error(w, "unknown report "+mux.Vars(r)["report"], http.StatusNotFound)
+		return
+	}
+	preview, err := mail.GetPreview(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	t, err := template.ParseFiles("preview.html")
+	if err != nil {
+		log.Print("ERROR: PreviewPage template parsing error: ", err)
+		return
+	}
+	if err = t.Execute(w, PreviewPageVariables{LocalServer: true, Preview: preview}); err != nil {
+		log.Print("ERROR: PreviewPage template executing error: ", err)
+	}
+}
+
 // Get preferred outbound ip of this machine
 // Ref: https://stackoverflow.com/a/37382208/1402287
 func getOutboundIP() net.IP {
@@ -138,23 +243,68 @@ func getOutboundIP() net.IP {
 
 // ------------------------------------------
 
-func makeGen(key int) mail.EmailGen {
+// Writes the alerts as an html list under the heading.
+func writeAlerts(body *bytes.Buffer, heading string, alerts []alert.Alert) {
+	body.WriteString("<h4>" + heading + "</h4>\n")
+	if len(alerts) == 0 {
+		body.WriteString("<p>none</p>\n")
+		return
+	}
+	body.WriteString("<ul>\n")
+	for _, a := range alerts {
+		line := strings.ToUpper(a.Severity) + " " + a.Source + " " + a.Rule + ": " + a.Message + " (since " + a.Since + ")"
+		body.WriteString("<li>" + template.HTMLEscapeString(line) + "</li>\n")
+	}
+	body.WriteString("</ul>\n")
+}
+
+// Adds a summary line to the body, and a csv attachment, for the diff of each source
+// that has a manifest.
+func attachManifests(body *bytes.Buffer, attachments *[]notify.Attachment) {
+	diffs, _ := manifest.GetDiffs("")
+	for _, d := range diffs {
+		body.WriteString("<br>" + template.HTMLEscapeString(d.Summary()) + "\n")
+		if d.Error != "" {
+			continue
+		}
+		var csv bytes.Buffer
+		if err := manifest.WriteCsv(&csv, d); err != nil {
+			log.Print("ERROR: manifest csv error: ", err)
+			continue
+		}
+		*attachments = append(*attachments, notify.Attachment{
+			Name: "manifest-" + d.Source + ".csv", ContentType: "text/csv", Data: csv.Bytes(),
+		})
+	}
+}
+
+// Joins the one line summary of each status, for a report subject.
+func summarise(statuses []status.BackupStatus) string {
+	var summaries []string
+	for _, backupStatus := range statuses {
+		summaries = append(summaries, backupStatus.Summary())
+	}
+	return strings.Join(summaries, "; ")
+}
+
+// Returns the generator of the report with the key. A preview generator makes the same
+// report, but without changing anything (see mail.PreviewGens).
+func makeGen(key int, preview bool) mail.EmailGen {
 	keyName := config.KeyName[key]
 
 	switch key {
 	case config.KEY_HISTORY:
-		return func(body *bytes.Buffer) (subject string, err error) {
-			if config.Get().HistoryFileAutoAppend {
-				// Optionally create a new BackupStatus and append to
-				// the History, which is then emailed in the report.
-				backupStatus, err := status.GetBackupStatus()
-				if err == nil {
-					status.SaveStatusToHistory(*backupStatus)
-				}
+		return func(body *bytes.Buffer, attachments *[]notify.Attachment) (subject string, err error) {
+			if config.Get().HistoryFileAutoAppend && !preview {
+				// Optionally create a new BackupStatus for each source and
+				// append to the History, which is then emailed in the report.
+				status.AppendToHistory()
 			}
 			subject = keyName + " report"
+			// The zero Filter emails every record, unpaged.
 			historyPageVariables := status.HistoryPageVariables{
 				LocalServer: false,
+				Range:       status.RANGE_ALL,
 			}
 			reportTime := time.Now().Format(config.TIME_FORMAT)
 			body.Write([]byte("ReportTime <b>" + reportTime + "</b>\n"))
@@ -163,39 +313,82 @@ func makeGen(key int) mail.EmailGen {
 				body.WriteString(err.Error())
 				subject = subject + ": FAILED"
 			} else {
-				// Use the most recent history record in the subject
+				// Use the most recent history record of each source in the subject
 				if historyPageVariables.Error != "" {
 					subject = subject + ": FAILED - " + historyPageVariables.Error
 				} else {
-					if len := len(historyPageVariables.History); len > 0 {
-						backupStatus := historyPageVariables.History[len-1]
-						c := strconv.Itoa(int(backupStatus.MissingFiles))
-						d := status.ShortenTimeDiff(backupStatus.AcerAge)
-						subject = subject + ": MISSING(" + c + ") AGE(" + d + ")"
-					}
+					subject = subject + ": " + summarise(status.LatestBySource(historyPageVariables.History))
 				}
 			}
+			attachManifests(body, attachments)
 			return subject, err
 		}
+	case config.KEY_ALERT:
+		return func(body *bytes.Buffer, attachments *[]notify.Attachment) (subject string, err error) {
+			statuses := status.Latest().Statuses
+			check := alert.Check
+			if preview {
+				check = alert.Preview
+			}
+			fired, resolved, current := check(config.Get().AlertRules, statuses)
+			if len(fired) == 0 && len(resolved) == 0 {
+				if preview {
+					// Show the active alerts, although nothing would be sent.
+					body.Write([]byte("ReportTime <b>" + time.Now().Format(config.TIME_FORMAT) + "</b>\n"))
+					writeAlerts(body, "Active", current)
+					return keyName + " report: no alerts have fired or resolved", mail.ErrNothingToSend
+				}
+				return "", mail.ErrNothingToSend
+			}
+			subject = keyName + " report:"
+			if len(fired) > 0 {
+				subject = subject + " " + strings.ToUpper(alert.HighestSeverity(fired))
+				for _, a := range fired {
+					subject = subject + " - " + a.Source + " " + a.Message
+				}
+			}
+			for _, a := range resolved {
+				subject = subject + " - RESOLVED " + a.Source + " " + a.Rule
+			}
+			body.Write([]byte("ReportTime <b>" + time.Now().Format(config.TIME_FORMAT) + "</b>\n"))
+			writeAlerts(body, "Fired", fired)
+			writeAlerts(body, "Resolved", resolved)
+			writeAlerts(body, "Active", current)
+			return subject, nil
+		}
 	case config.KEY_STATUS:
-		return func(body *bytes.Buffer) (subject string, err error) {
+		return func(body *bytes.Buffer, attachments *[]notify.Attachment) (subject string, err error) {
 			subject = keyName + " report"
 			body.Write([]byte("ReportTime <b>" + time.Now().Format(config.TIME_FORMAT) + "</b>\n"))
-			backupStatus, err := status.GetBackupStatus()
-			if err != nil {
-				subject = subject + ": FAILED - " + err.Error()
+			// The report is sent on request, so poll the sources now (but a preview only
+			// shows the latest poll, since polling replaces the snapshot).
+			var snapshot status.Snapshot
+			if preview {
+				snapshot = status.Latest()
+			} else {
+				snapshot = status.Refresh()
+			}
+			statuses := snapshot.Statuses
+			if len(statuses) == 0 {
+				subject = subject + ": FAILED - " + snapshot.Error
+				err = errors.New(snapshot.Error)
 			} else {
-				status.SaveStatusToHistory(*backupStatus)
-				c := strconv.Itoa(int(backupStatus.MissingFiles))
-				d := status.ShortenTimeDiff(backupStatus.AcerAge)
-				subject = subject + ": MISSING(" + c + ") AGE(" + d + ")"
+				// One line per source, in both the subject and the body.
+				for _, backupStatus := range statuses {
+					if !preview {
+						status.SaveStatusToHistory(backupStatus)
+					}
+					body.WriteString("<br>" + template.HTMLEscapeString(backupStatus.Summary()) + "\n")
+				}
+				subject = subject + ": " + summarise(statuses)
 			}
+			attachManifests(body, attachments)
 			return subject, err
 		}
 	default:
 		// case mail.KEY_REPORTER:
 		// case mail.KEY_SIMMON:
-		return func(body *bytes.Buffer) (subject string, err error) {
+		return func(body *bytes.Buffer, attachments *[]notify.Attachment) (subject string, err error) {
 			subject = keyName + " report"
 			loggingPageVars := logging.LoggingPageVariables{
 				LocalServer: false,
@@ -219,5 +412,4 @@ func makeGen(key int) mail.EmailGen {
 			return subject, err
 		}
 	}
-	return nil
 }
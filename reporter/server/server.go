@@ -0,0 +1,145 @@
+package server
+
+// Serves the pages over http, or https if EnableTls. The certificate and key are read from
+// TlsCertFile and TlsKeyFile [cert.pem and key.pem beside the config]; if neither exists
+// then a self-signed certificate is generated there on the first start. Browsers will warn
+// about a self-signed certificate, so its fingerprint is logged for checking.
+// If TlsRedirectPort is set, plain http requests on that port are redirected to https.
+// Test:  curl -sk https://localhost:8090/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"reporter/config"
+	"time"
+)
+
+const (
+	CERT_YEARS = 10 // Validity of a generated certificate
+)
+
+// Returns the paths of the certificate and key.
+func TlsPaths(c config.Configuration) (certFile, keyFile string) {
+	certFile, keyFile = c.TlsCertFile, c.TlsKeyFile
+	if certFile == "" {
+		certFile = config.Beside("cert.pem")
+	}
+	if keyFile == "" {
+		keyFile = config.Beside("key.pem")
+	}
+	return certFile, keyFile
+}
+
+// Serves the handler on the configured Port until it fails. The hosts (names or ip
+// addresses) are those of a generated certificate.
+func Serve(handler http.Handler, hosts []string) error {
+	c := config.Get()
+	addr := ":" + c.Port
+	if !c.EnableTls {
+		return http.ListenAndServe(addr, handler)
+	}
+	certFile, keyFile := TlsPaths(c)
+	if !exists(certFile) && !exists(keyFile) {
+		if err := generateCert(certFile, keyFile, hosts); err != nil {
+			return err
+		}
+	}
+	logFingerprint(certFile)
+	if c.TlsRedirectPort != "" {
+		go redirect(c.TlsRedirectPort, c.Port)
+	}
+	return http.ListenAndServeTLS(addr, certFile, keyFile, handler)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Redirects every plain http request on the port to the same url with https on the tlsPort.
+func redirect(port, tlsPort string) {
+	log.Printf("redirecting http on port %s to https on port %s\n", port, tlsPort)
+	err := http.ListenAndServe(":"+port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // No port
+		}
+		target := "https://" + net.JoinHostPort(host, tlsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}))
+	log.Print("ERROR: https redirect: ", err)
+}
+
+// Writes a new self-signed certificate (and its key, readable only by the owner) for the hosts.
+func generateCert(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"syncbox reporter"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(CERT_YEARS, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	for _, h := range append(hosts, "localhost", "127.0.0.1", "::1") {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("generated a self-signed certificate for %v %v at %s\n", template.DNSNames, template.IPAddresses, certFile)
+	return nil
+}
+
+func logFingerprint(certFile string) {
+	content, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return // Reported by ListenAndServeTLS
+	}
+	if block, _ := pem.Decode(content); block != nil {
+		sum := sha256.Sum256(block.Bytes)
+		log.Printf("serving https with %s, sha256 fingerprint %s\n", certFile, hex.EncodeToString(sum[:]))
+	}
+}
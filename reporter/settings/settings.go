@@ -2,21 +2,31 @@ package settings
 
 import (
 	"errors"
-	// "fmt"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/mail"
 	"net/url"
+	"reporter/auth"
 	"reporter/config"
+	"reporter/notify"
+	"reporter/outbox"
+	"reporter/server"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type SettingsPageVariables struct {
 	LocalServer       bool
+	Csrf              string // For the form (see auth.CsrfToken)
 	SuccessMessage    string
+	SmtpTest          []string // The steps of the email connection test, if one was run
+	SmtpTestErrored   string   // Is either "errored" or ""
 	Settings          []Setting
 	AutoEmailSettings []AutoEmailSetting
+	Reports           []string // The names of the reports, for the send now/preview actions
 }
 
 type Setting struct {
@@ -25,6 +35,8 @@ type Setting struct {
 	Type        string
 	Value       string
 	Readonly    bool
+	Secret      bool // Write-only; the Value is always empty (see secretSetting)
+	IsSet       bool // For a Secret, whether it has a value
 	Errored     string
 	Checked     string // Is either "checked" or ""
 	Description string
@@ -32,9 +44,16 @@ type Setting struct {
 	// The validator's job is to read appropriate field value(s) from the request Form, place
 	// them into the setting for reply to the page, and also (if they validate OK) write them
 	// to the settings.
-	Validator func(f url.Values, c *config.Configuration, s *Setting) error
+	Validator func(f url.Values, c *config.Configuration, s *Setting) error `json:"-"`
 }
 
+// How many of the next times of an AutoEmailSchedule are shown.
+const SCHEDULE_PREVIEW_COUNT = 5
+
+// Placeholder returned by the api in place of the Value of a Secret setting that is set.
+// If it is sent back unchanged, then the current value is kept.
+const REDACTED = "********"
+
 // Create a Settings list from the specified Configuration values
 // with the Description set and the Errored empty.
 func getSettings(c config.Configuration) []Setting {
@@ -58,24 +77,11 @@ func getSettings(c config.Configuration) []Setting {
 		Value: c.Port, Description: "Reporter server listening port",
 		Readonly: true,
 	})
-	settings = append(settings, Setting{
-		Id: "SyncFolderId", Name: "Syncthing Folder Id", Type: "text",
-		Value: c.SyncFolderId, Description: "Identifies folder being monitored (from Syncthing-GUI)",
-		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
-			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
-			c.SyncFolderId = s.Value
-			return nil
-		},
-	})
-	settings = append(settings, Setting{
-		Id: "SyncApiKey", Name: "Syncthing API Key", Type: "text",
-		Value: c.SyncApiKey, Description: "Authorises API access (from Syncthing-GUI)",
-		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
-			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
-			c.SyncApiKey = s.Value
-			return nil
-		},
-	})
+	settings = append(settings, getFolderSettings(c)...)
+	settings = append(settings, getSourceSettings(c)...)
+	settings = append(settings, secretSetting("SyncApiKey", "Syncthing API Key",
+		"Authorises API access (from Syncthing-GUI)", c.SyncApiKey,
+		func(c *config.Configuration) *string { return &c.SyncApiKey }))
 	settings = append(settings, Setting{
 		Id: "EmailFrom", Name: "Email Account", Type: "text",
 		Value: c.EmailFrom, Description: "Email account address used to send reports",
@@ -94,80 +100,177 @@ func getSettings(c config.Configuration) []Setting {
 				return errors.New("not a valid email address")
 			} else {
 				c.EmailFrom = s.Value
-				c.EmailUserName = s.Value[0:end]
 				return nil
 			}
 		},
 	})
-
 	settings = append(settings, Setting{
-		Id: "EmailPassword", Name: "Email Password", Type: "text",
-		Value: c.EmailPassword, Description: "Email account password used to send reports",
+		Id: "EmailHost", Name: "Email Server", Type: "text",
+		Value: c.EmailHost, Description: "Host name of the smtp server (or local relay) used to send reports",
 		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
-			s.Value = f.Get(s.Id)
-			c.EmailPassword = s.Value
+			s.Value = strings.TrimSpace(f.Get(s.Id))
+			c.EmailHost = s.Value
 			return nil
 		},
 	})
 	settings = append(settings, Setting{
-		Id: "EmailTo", Name: "Email Target", Type: "text",
-		Value: c.EmailTo, Description: "Target email address for all reports",
+		Id: "EmailPort", Name: "Email Port", Type: "number",
+		Value:       strconv.Itoa(c.EmailPort),
+		Description: "Port of the smtp server (0 for the default of the tls mode; 465, 587 or 25)",
 		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
-			s.Value = f.Get(s.Id)
-			c.EmailTo = s.Value
+			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+			var err error
+			if c.EmailPort, err = strconv.Atoi(s.Value); err == nil {
+				if c.EmailPort < 0 || c.EmailPort > 65535 {
+					err = errors.New("out of range (0,65535)")
+				}
+			}
+			return err
+		},
+	})
+	settings = append(settings, choiceSetting("EmailTls", "Email TLS", c.EmailTls, config.EMAIL_TLS_IMPLICIT,
+		"One of "+strings.Join(config.EmailTlsModes, ", ")+" (none for a local relay)", config.EmailTlsModes,
+		func(c *config.Configuration) *string { return &c.EmailTls }))
+	settings = append(settings, choiceSetting("EmailAuth", "Email Auth", c.EmailAuth, config.EMAIL_AUTH_PLAIN,
+		"One of "+strings.Join(config.EmailAuthMechanisms, ", ")+" (none if there is no user name)",
+		config.EmailAuthMechanisms,
+		func(c *config.Configuration) *string { return &c.EmailAuth }))
+	settings = append(settings, Setting{
+		Id: "EmailUserName", Name: "Email User Name", Type: "text",
+		Value: c.EmailUserName, Description: "User name of the email account (often the address)",
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Value = strings.TrimSpace(f.Get(s.Id))
+			c.EmailUserName = s.Value
 			return nil
 		},
 	})
+
+	settings = append(settings, secretSetting("EmailPassword", "Email Password",
+		"Email account password used to send reports", c.EmailPassword,
+		func(c *config.Configuration) *string { return &c.EmailPassword }))
+	settings = append(settings, Setting{
+		Id: "OutboxExpiryHours", Name: "Outbox Expiry Hours", Type: "number",
+		Value:       strconv.Itoa(c.OutboxExpiryHours),
+		Description: "Hours after which unsent reports are dropped from the outbox (0 for the default of 24)",
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+			newVal, err := strconv.Atoi(s.Value)
+			if err == nil {
+				if newVal >= 0 {
+					c.OutboxExpiryHours = newVal
+				} else {
+					err = errors.New("out of range (0,)")
+				}
+			}
+			return err
+		},
+	})
+	settings = append(settings, Setting{
+		Id: "OutboxPath", Name: "Outbox", Type: "text",
+		Value: outbox.Path(c), Readonly: true,
+		Description: "Reports waiting to be sent, retried until they expire",
+	})
+	settings = append(settings, Setting{
+		Id: "SecretsPath", Name: "Secrets Store", Type: "text",
+		Value: config.SecretsPath(c), Readonly: true,
+		Description: "Encrypted store of the secrets, with the key from " + config.SecretsKeySource(c),
+	})
+	settings = append(settings, Setting{
+		Id: "EnableTls", Name: "Serve HTTPS", Type: "checkbox",
+		Checked: formatChecked(c.EnableTls), Readonly: true,
+		Description: "With the certificate " + tlsCertFile(c) + " (changes need a restart)",
+	})
+	settings = append(settings, Setting{
+		Id: "UsersFile", Name: "Users File", Type: "text",
+		Value: auth.UsersPath(c), Readonly: true,
+		Description: "Logins, added with the -adduser flag; if there are none then login is not required",
+	})
 	settings = append(settings, Setting{
 		// For checkboxes, the Value is always "checked" and the Checked field is set
 		// from the form and written to the html input.
-		Id: "EnableAcerFileWatch", Name: "Acer File Watch", Type: "checkbox",
+		Id: "EnableSourceFileWatch", Name: "Source File Watch", Type: "checkbox",
 		Value:       "checked",
-		Checked:     formatChecked(c.EnableAcerFileWatch),
-		Description: "Create and email new history record, on acer file change",
+		Checked:     formatChecked(c.EnableSourceFileWatch),
+		Description: "Create new history records, on source status file change",
 		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
 			s.Checked = f.Get(s.Id)
-			// has value changed ?
-			oldVal := c.EnableAcerFileWatch
-			newVal := s.Checked != ""
-			c.EnableAcerFileWatch = newVal
-			if oldVal != newVal {
-				config.ReloadConfig(config.KEY_STATUS)
-			}
+			c.EnableSourceFileWatch = (s.Checked != "") // The watcher is told by ApplyForm
 			return nil
 		},
 	})
 	settings = append(settings, Setting{
-		Id: "AcerFilePath", Name: "Acer File Path", Type: "text",
-		Value: c.AcerFilePath, Description: "Location of file containing AcerStatus",
+		Id: "SourceFileWatchPeriod", Name: "Source File Period", Type: "number",
+		Value:       strconv.Itoa(c.SourceFileWatchPeriod),
+		Description: "File polling period in seconds (0 for the default of 10)",
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+			newVal, err := strconv.Atoi(s.Value)
+			if err == nil {
+				if newVal < 0 {
+					err = errors.New("out of range (0,)")
+				} else if newVal > 0 && newVal < 10 {
+					// The watcher polls at least every 10 seconds (as config.Validate warns).
+					newVal = 10
+					s.Value = "10"
+				}
+				if err == nil {
+					c.SourceFileWatchPeriod = newVal
+				}
+			}
+			return err
+		},
+	})
+	settings = append(settings, Setting{
+		Id: "AlertCheckPeriod", Name: "Alert Check Period", Type: "number",
+		Value:       strconv.Itoa(c.AlertCheckPeriod),
+		Description: "Polling period in seconds for evaluating the alert rules (0 for the default of 10)",
 		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
 			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
-			// has value changed ?
-			oldVal := c.AcerFilePath
-			newVal := s.Value
-			c.AcerFilePath = newVal
-			if oldVal != newVal {
-				config.ReloadConfig(config.KEY_STATUS)
+			newVal, err := strconv.Atoi(s.Value)
+			if err == nil {
+				if newVal == 0 || newVal >= 10 {
+					c.AlertCheckPeriod = newVal
+				} else {
+					err = errors.New("out of range (0 or 10,)")
+				}
 			}
+			return err
+		},
+	})
+	settings = append(settings, Setting{
+		Id: "EnableSyncEvents", Name: "Syncthing Events", Type: "checkbox",
+		Value:       "checked",
+		Checked:     formatChecked(c.EnableSyncEvents),
+		Description: "Follow the syncthing event stream, to keep the status current between polls",
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Checked = f.Get(s.Id)
+			c.EnableSyncEvents = (s.Checked != "") // The subscriber is told by ApplyForm
 			return nil
 		},
 	})
 	settings = append(settings, Setting{
-		Id: "AcerFileWatchPeriod", Name: "Acer File Period", Type: "number",
-		Value:       strconv.Itoa(c.AcerFileWatchPeriod),
-		Description: "File polling period in seconds",
+		Id: "SyncEventsAutoEmail", Name: "Status On Sync", Type: "checkbox",
+		Value:       "checked",
+		Checked:     formatChecked(c.SyncEventsAutoEmail),
+		Description: "Email the status report when a folder becomes idle after syncing (needs Syncthing Events)",
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Checked = f.Get(s.Id)
+			c.SyncEventsAutoEmail = (s.Checked != "")
+			return nil
+		},
+	})
+	settings = append(settings, Setting{
+		Id: "StatusPollPeriod", Name: "Status Poll Period", Type: "number",
+		Value:       strconv.Itoa(c.StatusPollPeriod),
+		Description: "Polling period in seconds for the latest backup status (0 for the default of 60)",
 		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
 			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
-			oldVal := c.AcerFileWatchPeriod
 			newVal, err := strconv.Atoi(s.Value)
 			if err == nil {
-				if c.AcerFileWatchPeriod >= 10 {
-					c.AcerFileWatchPeriod = newVal
-					if oldVal != newVal {
-						config.ReloadConfig(config.KEY_STATUS)
-					}
+				if newVal == 0 || newVal >= 10 {
+					c.StatusPollPeriod = newVal // The poller is told by ApplyForm
 				} else {
-					err = errors.New("out of range (10,)")
+					err = errors.New("out of range (0 or 10,)")
 				}
 			}
 			return err
@@ -191,6 +294,50 @@ func getSettings(c config.Configuration) []Setting {
 		Value: c.HistoryFile, Description: "Path to History file of backup status's",
 		Readonly: true,
 	})
+	settings = append(settings, Setting{
+		Id: "HistoryStore", Name: "History Store", Type: "text",
+		Value: c.HistoryStore, Description: "Either bolt (a database, the default) or json (the History file)",
+		Readonly: true,
+	})
+	settings = append(settings, Setting{
+		Id: "HistoryDbPath", Name: "History Database Path", Type: "text",
+		Value: c.HistoryDbPath, Description: "Path to History database (defaults to the History file path, with .db)",
+		Readonly: true,
+	})
+	settings = append(settings, Setting{
+		Id: "HistoryKeepAllDays", Name: "History Keep All Days", Type: "number",
+		Value:       strconv.Itoa(c.HistoryKeepAllDays),
+		Description: "Days that every history record is kept, after which only the last of each day is kept (0 for all)",
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+			newVal, err := strconv.Atoi(s.Value)
+			if err == nil {
+				if newVal >= 0 {
+					c.HistoryKeepAllDays = newVal
+				} else {
+					err = errors.New("out of range (0,)")
+				}
+			}
+			return err
+		},
+	})
+	settings = append(settings, Setting{
+		Id: "HistoryKeepDays", Name: "History Keep Days", Type: "number",
+		Value:       strconv.Itoa(c.HistoryKeepDays),
+		Description: "Days after which history records are removed (0 for forever)",
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+			newVal, err := strconv.Atoi(s.Value)
+			if err == nil {
+				if newVal >= 0 {
+					c.HistoryKeepDays = newVal
+				} else {
+					err = errors.New("out of range (0,)")
+				}
+			}
+			return err
+		},
+	})
 	settings = append(settings, Setting{
 		Id: "ReporterLogFilePath", Name: "Reporter Log Path", Type: "text",
 		Value: c.ReporterLogFilePath, Description: "Path to logfile for Reporter",
@@ -201,15 +348,340 @@ func getSettings(c config.Configuration) []Setting {
 		Value: c.SimmonLogFilePath, Description: "Path to logfile for Simmon",
 		Readonly: true,
 	})
+	settings = append(settings, getRecipientSettings(c)...)
+	return settings
+}
+
+// Returns a write-only setting for a secret, which is never sent to the page. An empty
+// form value keeps the current secret, unless the <Id>_Clear checkbox is checked.
+func secretSetting(id, name, description, current string, field func(c *config.Configuration) *string) Setting {
+	return Setting{
+		Id: id, Name: name, Type: "password",
+		Secret: true, IsSet: current != "", Description: description,
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			if value := f.Get(s.Id); value != "" {
+				*field(c) = value
+				s.IsSet = true
+			} else if parseChecked(f.Get(s.Id + "_Clear")) {
+				*field(c) = ""
+				s.IsSet = false
+			}
+			return nil
+		},
+	}
+}
+
+func tlsCertFile(c config.Configuration) string {
+	certFile, _ := server.TlsPaths(c)
+	return certFile
+}
+
+// Creates the settings for each of the monitored folders, plus an empty set of settings
+// for adding a new folder. A folder is removed by clearing all its settings.
+// Setting ids are suffixed by the folder index, eg SyncFolderId_0, SyncFolderName_0
+func getFolderSettings(c config.Configuration) []Setting {
+	var settings []Setting
+	for i := 0; i <= len(c.SyncFolders); i++ {
+		folder := config.SyncFolder{}
+		name := "New Folder"
+		if i < len(c.SyncFolders) {
+			folder = c.SyncFolders[i]
+			name = "Folder " + strconv.Itoa(i+1)
+		}
+		index := i // For capture by the validators
+		suffix := "_" + strconv.Itoa(i)
+		settings = append(settings, Setting{
+			Id: "SyncFolderId" + suffix, Name: name + " Id", Type: "text",
+			Value: folder.Id, Description: "Identifies folder being monitored (from Syncthing-GUI)",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				if s.Value == "" {
+					if f.Get("SyncFolderName"+suffix) != "" || f.Get("SyncFolderPath"+suffix) != "" {
+						return errors.New("required (clear all the folder's settings to remove it)")
+					}
+				}
+				for j, other := range c.SyncFolders {
+					if j < index && s.Value != "" && other.Id == s.Value {
+						return errors.New("duplicate folder id")
+					}
+				}
+				folderAt(c, index).Id = s.Value
+				return nil
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "SyncFolderName" + suffix, Name: name + " Name", Type: "text",
+			Value: folder.Name, Description: "Name shown on pages and reports (defaults to the Id)",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				folderAt(c, index).Name = s.Value
+				return nil
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "SyncFolderPath" + suffix, Name: name + " Local Path", Type: "text",
+			Value: folder.LocalPath, Description: "Directory of the folder on this server, for the manifest diff (if empty, syncthing is asked)",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				folderAt(c, index).LocalPath = s.Value
+				return nil
+			},
+		})
+	}
+	return settings
+}
+
+// Returns the folder at the index, growing the SyncFolders if needed.
+func folderAt(c *config.Configuration, index int) *config.SyncFolder {
+	for len(c.SyncFolders) <= index {
+		c.SyncFolders = append(c.SyncFolders, config.SyncFolder{})
+	}
+	return &c.SyncFolders[index]
+}
+
+// Creates the settings for each of the source machines, plus an empty set of settings
+// for adding a new source. A source is removed by clearing all its settings.
+// Setting ids are suffixed by the source index, eg SourceName_0, StatusFilePath_0
+func getSourceSettings(c config.Configuration) []Setting {
+	var settings []Setting
+	for i := 0; i <= len(c.Sources); i++ {
+		source := config.Source{}
+		name := "New Source"
+		if i < len(c.Sources) {
+			source = c.Sources[i]
+			name = "Source " + strconv.Itoa(i+1)
+		}
+		index := i // For capture by the validators
+		suffix := "_" + strconv.Itoa(i)
+		settings = append(settings, Setting{
+			Id: "SourceName" + suffix, Name: name + " Name", Type: "text",
+			Value: source.Name, Description: "Identifies the machine on pages, reports and history",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				if s.Value == "" {
+					if f.Get("StatusFilePath"+suffix) != "" || f.Get("SourceFolderId"+suffix) != "" || f.Get("SourceManifestPath"+suffix) != "" {
+						return errors.New("required (clear all the source's settings to remove it)")
+					}
+				}
+				for j, other := range c.Sources {
+					if j < index && s.Value != "" && other.Name == s.Value {
+						return errors.New("duplicate source name")
+					}
+				}
+				sourceAt(c, index).Name = s.Value
+				return nil
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "StatusFilePath" + suffix, Name: name + " Status File", Type: "text",
+			Value: source.StatusFilePath, Description: "Location of status report file written by the machine",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				sourceAt(c, index).StatusFilePath = s.Value
+				return nil
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "SourceTimeZone" + suffix, Name: name + " Time Zone", Type: "text",
+			Value: source.TimeZone, Description: "Zone name (eg Australia/Sydney) or abbreviation (eg AEDT) of the status file times",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				sourceAt(c, index).TimeZone = s.Value
+				return nil
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "SourceFolderId" + suffix, Name: name + " Folder Id", Type: "text",
+			Value: source.FolderId, Description: "Id of the monitored folder that the machine feeds",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				sourceAt(c, index).FolderId = s.Value
+				if f.Get("SourceName"+suffix) == "" {
+					return nil // Being removed
+				}
+				if _, ok := c.Folder(s.Value); !ok {
+					return errors.New("not one of the monitored folders")
+				}
+				return nil
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "SourceManifestPath" + suffix, Name: name + " Manifest", Type: "text",
+			Value: source.ManifestPath, Description: "Location of the (optional) manifest of the machine's files, for the manifest diff",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				sourceAt(c, index).ManifestPath = s.Value
+				return nil
+			},
+		})
+	}
+	return settings
+}
+
+// Creates a setting whose value is one of the choices (matched ignoring case). An empty
+// value is shown as, and saved as, the default.
+func choiceSetting(id, name, current, def, description string, choices []string, field func(c *config.Configuration) *string) Setting {
+	if current == "" {
+		current = def
+	}
+	return Setting{
+		Id: id, Name: name, Type: "text",
+		Value: current, Description: description,
+		Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+			s.Value = strings.TrimSpace(f.Get(s.Id)) // [s.Id] Unconditionally return to the page
+			if s.Value == "" {
+				s.Value = def
+			}
+			for _, choice := range choices {
+				if strings.EqualFold(s.Value, choice) {
+					s.Value = choice
+					*field(c) = choice
+					return nil
+				}
+			}
+			return errors.New("not one of " + strings.Join(choices, ", "))
+		},
+	}
+}
+
+// Creates the settings for each of the email recipients, plus an empty set of settings
+// for adding a new recipient. A recipient is removed by clearing its address.
+// Setting ids are suffixed by the recipient index, eg RecipientAddress_0, RecipientKind_0
+func getRecipientSettings(c config.Configuration) []Setting {
+	var settings []Setting
+	for i := 0; i <= len(c.Recipients); i++ {
+		recipient := config.Recipient{Kind: config.RECIPIENT_TO}
+		name := "New Recipient"
+		if i < len(c.Recipients) {
+			recipient = c.Recipients[i]
+			name = "Recipient " + strconv.Itoa(i+1)
+		}
+		index := i // For capture by the validators
+		suffix := "_" + strconv.Itoa(i)
+		settings = append(settings, Setting{
+			Id: "RecipientAddress" + suffix, Name: name + " Address", Type: "text",
+			Value: recipient.Address, Description: "Email address that reports are sent to",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				recipientAt(c, index).Address = s.Value
+				if s.Value == "" {
+					return nil // Being removed
+				}
+				if _, err := mail.ParseAddress(s.Value); err != nil {
+					return errors.New("not a valid email address")
+				}
+				return nil
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "RecipientKind" + suffix, Name: name + " Kind", Type: "text",
+			Value: recipient.Kind, Description: "One of " + strings.Join(config.RecipientKinds, ", "),
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				for _, kind := range config.RecipientKinds {
+					if strings.EqualFold(s.Value, kind) {
+						s.Value = kind
+						recipientAt(c, index).Kind = kind
+						return nil
+					}
+				}
+				if s.Value == "" || f.Get("RecipientAddress"+suffix) == "" {
+					recipientAt(c, index).Kind = config.RECIPIENT_TO
+					return nil
+				}
+				return errors.New("not one of " + strings.Join(config.RecipientKinds, ", "))
+			},
+		})
+		settings = append(settings, Setting{
+			Id: "RecipientReports" + suffix, Name: name + " Reports", Type: "text",
+			Value:       strings.Join(recipient.Reports, ", "),
+			Description: "Reports sent to the address, eg HISTORY, STATUS (empty for all)",
+			Validator: func(f url.Values, c *config.Configuration, s *Setting) error {
+				s.Value = f.Get(s.Id) // [s.Id] Unconditionally return to the page
+				var reports []string
+				for _, report := range strings.Split(s.Value, ",") {
+					report = strings.ToUpper(strings.TrimSpace(report))
+					if report == "" {
+						continue
+					}
+					if !isReport(report) {
+						return errors.New("unknown report " + report)
+					}
+					reports = append(reports, report)
+				}
+				recipientAt(c, index).Reports = reports
+				return nil
+			},
+		})
+	}
 	return settings
 }
 
+// Returns the recipient at the index, growing the Recipients if needed.
+func recipientAt(c *config.Configuration, index int) *config.Recipient {
+	for len(c.Recipients) <= index {
+		c.Recipients = append(c.Recipients, config.Recipient{})
+	}
+	return &c.Recipients[index]
+}
+
+// Removes any recipients that were cleared on the page.
+func compactRecipients(recipients []config.Recipient) []config.Recipient {
+	var compacted []config.Recipient
+	for _, recipient := range recipients {
+		if recipient.Address != "" {
+			compacted = append(compacted, recipient)
+		}
+	}
+	return compacted
+}
+
+// Returns true if the name is of a report (rather than a goroutine such as the POLLER).
+func isReport(name string) bool {
+	_, ok := config.ReportKey(name)
+	return ok
+}
+
+// Returns the source at the index, growing the Sources if needed.
+func sourceAt(c *config.Configuration, index int) *config.Source {
+	for len(c.Sources) <= index {
+		c.Sources = append(c.Sources, config.Source{})
+	}
+	return &c.Sources[index]
+}
+
+// Removes any sources that were cleared on the page.
+func compactSources(sources []config.Source) []config.Source {
+	var compacted []config.Source
+	for _, source := range sources {
+		if source.Name != "" {
+			compacted = append(compacted, source)
+		}
+	}
+	return compacted
+}
+
+// Removes any folders that were cleared on the page.
+func compactFolders(folders []config.SyncFolder) []config.SyncFolder {
+	var compacted []config.SyncFolder
+	for _, folder := range folders {
+		if folder.Id != "" {
+			compacted = append(compacted, folder)
+		}
+	}
+	return compacted
+}
+
 type AutoEmailSetting struct {
 	Id          string
 	Name        string
 	Checked     string // Is either "checked" or ""
 	Count       string
 	Period      string
+	Schedule    string   // A cron expression, used instead of the Count and Period if set
+	Preview     []string // The next few times of the Schedule
+	CatchUp     string   // The policy for missed reports; one of config.CatchUpPolicies
+	LastMissed  string
 	NextEmail   string
 	Description string
 	Errored     string
@@ -218,7 +690,7 @@ type AutoEmailSetting struct {
 	// The validator's job is to read appropriate field value(s) from the request Form, place
 	// them into the setting for reply to the page, and also (if they validate OK) write them
 	// to the config.
-	Validator func(f url.Values, s *AutoEmailSetting, c *config.Configuration) error
+	Validator func(f url.Values, s *AutoEmailSetting, c *config.Configuration) error `json:"-"`
 }
 
 // The Validator takes a new value (as the entered string), validates it and stores
@@ -257,6 +729,10 @@ func makeAutoEmailSetting(shortName string, id string, c config.Configuration, g
 		Checked:     formatChecked(aec.AutoEmailEnable),
 		Count:       strconv.Itoa(aec.AutoEmailCount),
 		Period:      aec.AutoEmailPeriod,
+		Schedule:    aec.AutoEmailSchedule,
+		Preview:     previewSchedule(aec.AutoEmailSchedule),
+		CatchUp:     catchUpPolicy(aec.AutoEmailCatchUp),
+		LastMissed:  aec.AutoEmailLastMissed,
 		NextEmail:   aec.AutoEmailNext,
 		Description: "Check to enable auto emailing of " + shortName + " logs",
 		Key:         key,
@@ -266,33 +742,119 @@ func makeAutoEmailSetting(shortName string, id string, c config.Configuration, g
 			// changed from clear (during which the Count, Period can be entered) to set (after which
 			// Count and Period are readonly).
 			s.Checked = f.Get(shortName + "LogAutoEmail_Checked")
-			// checkbox has changed from set -> clear
-			reload := (aec.AutoEmailEnable && (s.Checked == ""))
 
-			if !aec.AutoEmailEnable && (s.Checked != "") {
-				// checkbox has changed from clear -> set
-				reload = true
+			if !aec.AutoEmailEnable {
+				// While clear, the Count, Period and Schedule are saved (so that the
+				// Schedule can be previewed before enabling).
 				s.Count = f.Get(shortName + "LogAutoEmail_Count")
 				s.Period = f.Get(shortName + "LogAutoEmail_Period")
-				// Update the Period, count, next fields
+				s.Schedule = strings.TrimSpace(f.Get(shortName + "LogAutoEmail_Schedule"))
+				if s.Schedule != "" {
+					if err := config.CheckCron(s.Schedule); err != nil {
+						return err
+					}
+				}
 				aec.AutoEmailCount, _ = strconv.Atoi(s.Count)
 				aec.AutoEmailPeriod = s.Period
-				// Calculate next as now plus the specified period
-				_, s.NextEmail = CalculateNextTime(time.Now(), aec.AutoEmailCount, aec.AutoEmailPeriod)
-				aec.AutoEmailNext = s.NextEmail
+				aec.AutoEmailSchedule = s.Schedule
+				s.Preview = previewSchedule(s.Schedule)
 			} else {
 				s.Count = strconv.Itoa(aec.AutoEmailCount)
 				s.Period = aec.AutoEmailPeriod
+				s.Schedule = aec.AutoEmailSchedule
 			}
-			aec.AutoEmailEnable = (s.Checked != "")
-			if reload {
-				config.ReloadConfig(key)
+			// The catch-up policy may be changed at any time.
+			s.CatchUp = catchUpPolicy(f.Get(shortName + "LogAutoEmail_CatchUp"))
+			if !validCatchUp(s.CatchUp) {
+				return errors.New("catch-up policy not one of " + strings.Join(config.CatchUpPolicies, ", "))
 			}
+			aec.AutoEmailCatchUp = s.CatchUp
+			if !aec.AutoEmailEnable && (s.Checked != "") {
+				// checkbox has changed from clear -> set
+				// Calculate next from now, by the schedule or the period
+				var err error
+				if _, s.NextEmail, err = NextEmailTime(time.Now(), *aec); err != nil {
+					return err
+				}
+				aec.AutoEmailNext = s.NextEmail
+			}
+			aec.AutoEmailEnable = (s.Checked != "") // The mailer is told by ApplyForm
 			return nil
 		},
 	}
 }
 
+// Returns the time of the next email after the time; the next time of the AutoEmailSchedule
+// if there is one, otherwise the time plus the AutoEmailCount of AutoEmailPeriods.
+func NextEmailTime(from time.Time, aec config.AutoEmailConfig) (time.Time, string, error) {
+	if aec.AutoEmailSchedule != "" {
+		schedule, err := config.ParseCron(aec.AutoEmailSchedule)
+		if err != nil {
+			return from, "", err
+		}
+		next := schedule.Next(from)
+		if next.IsZero() {
+			return from, "", errors.New("'" + aec.AutoEmailSchedule + "' never fires")
+		}
+		return next, next.Format(config.TIME_FORMAT), nil
+	}
+	if aec.AutoEmailCount < 1 || !validPeriod(aec.AutoEmailPeriod) {
+		return from, "", fmt.Errorf("no schedule, and no period in %d '%s'", aec.AutoEmailCount, aec.AutoEmailPeriod)
+	}
+	next, nextEmail := CalculateNextTime(from, aec.AutoEmailCount, aec.AutoEmailPeriod)
+	return next, nextEmail, nil
+}
+
+// Describes when the emails are sent, eg "every 1 days" or "schedule 0 8 * * MON".
+func DescribeSchedule(aec config.AutoEmailConfig) string {
+	if aec.AutoEmailSchedule != "" {
+		return "schedule " + aec.AutoEmailSchedule
+	}
+	return fmt.Sprintf("every %d %s", aec.AutoEmailCount, aec.AutoEmailPeriod)
+}
+
+// Returns the policy, or the default (skip) if it is not set.
+func catchUpPolicy(policy string) string {
+	if policy == "" {
+		return config.CATCHUP_SKIP
+	}
+	return policy
+}
+
+func validCatchUp(policy string) bool {
+	for _, p := range config.CatchUpPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func validPeriod(period string) bool {
+	for _, p := range config.AutoEmailPeriods {
+		if p == period {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the next few times of the schedule (none if there is no valid schedule).
+func previewSchedule(schedule string) []string {
+	if schedule == "" {
+		return nil
+	}
+	cron, err := config.ParseCron(schedule)
+	if err != nil {
+		return nil
+	}
+	var preview []string
+	for _, t := range cron.NextTimes(time.Now(), SCHEDULE_PREVIEW_COUNT) {
+		preview = append(preview, t.Format("Mon "+config.TIME_FORMAT+" MST"))
+	}
+	return preview
+}
+
 func CalculateNextTime(from time.Time, count int, period string) (time.Time, string) {
 	// Calculate next as now plus the specified period
 	switch period {
@@ -337,54 +899,24 @@ func getAutoEmailSettings(c config.Configuration) []AutoEmailSetting {
 }
 
 func SettingsPage(w http.ResponseWriter, r *http.Request) {
-	settingsPageVars := SettingsPageVariables{
-		LocalServer: true,
-	}
 	// Fetch the current config values into the page. For GET (initial page load)
 	// and for (POST, "reset") this will be the values 'returned' back to the page.
-	settingsPageVars.Settings = getSettings(config.Get())
-	settingsPageVars.AutoEmailSettings = getAutoEmailSettings(config.Get())
+	settingsPageVars := GetPageVariables()
+	settingsPageVars.LocalServer = true
+	settingsPageVars.Csrf = auth.CsrfToken(r)
 	// fmt.Printf("SettingsPage method ===> %v\n", r.Method)
 	if r.Method == http.MethodPost {
 		r.ParseForm()
 		if r.Form.Get("submit") == "yes" {
-			c := config.Get() // Use a temp local configuration
-			success := true
-			for s := 0; s < len(settingsPageVars.Settings); s++ {
-				setting := &settingsPageVars.Settings[s]
-				// Only check writeable settings.
-				// If there is a new value for the setting in the form, then store it in
-				// the setting (where it can be sent back to the page) and validate it,
-				// updating the local config with the new value. Indicate an error by
-				// placing error details in the Description field and setting Errored flag.
-				if !setting.Readonly {
-					// could also use "if val, ok := m[key]; ok" to test for contains
-					// fmt.Printf("===> USING form value '%s' for key %s\n", setting.Value, setting.Id)
-					if err := setting.Validator(r.Form, &c, setting); err != nil {
-						setting.Description = err.Error()
-						setting.Errored = "errored"
-						success = false
-					}
-				}
-				// fmt.Printf("setting after validating ==> %v\n", setting)
-			}
-			for a := 0; a < len(settingsPageVars.AutoEmailSettings); a++ {
-				auto := &settingsPageVars.AutoEmailSettings[a]
-				if err := auto.Validator(r.Form, auto, &c); err != nil {
-					auto.Description = err.Error()
-					auto.Errored = "errored"
-					success = false
-				}
-			}
-			// fmt.Printf("config after validating ==> %v\n", config)
-			if success {
-				// If all the settings are valid, then update the configuration.
-				if err := config.Set(c); err == nil {
-					settingsPageVars.SuccessMessage = "Settings updated successfully"
-				} else {
-					settingsPageVars.SuccessMessage = "Error saving config: " + err.Error()
-				}
-			}
+			settingsPageVars, _ = ApplyForm(r.Form)
+			settingsPageVars.LocalServer = true
+			settingsPageVars.Csrf = auth.CsrfToken(r)
+		} else if r.Form.Get("testsmtp") == "yes" {
+			settingsPageVars = TestSmtpForm(r.Form)
+			settingsPageVars.LocalServer = true
+			settingsPageVars.Csrf = auth.CsrfToken(r)
+		} else if report := r.Form.Get("sendnow"); report != "" {
+			settingsPageVars.SuccessMessage = SendNow(report)
 		}
 	}
 	t, err := template.ParseFiles("settings/settings.html")
@@ -396,3 +928,152 @@ func SettingsPage(w http.ResponseWriter, r *http.Request) {
 		log.Print("ERROR: SettingsPage template executing error: ", err)
 	}
 }
+
+// Returns the settings page variables filled from the current config.
+func GetPageVariables() SettingsPageVariables {
+	c := config.Get()
+	vars := SettingsPageVariables{
+		Settings:          getSettings(c),
+		AutoEmailSettings: getAutoEmailSettings(c),
+	}
+	for _, key := range config.ReportKeys {
+		vars.Reports = append(vars.Reports, config.KeyName[key])
+	}
+	return vars
+}
+
+// Asks the mailer of the named report to send it now, returning a message for the page.
+// The report is queued in the outbox as usual; the config is not changed.
+func SendNow(report string) string {
+	key, ok := config.ReportKey(report)
+	if !ok {
+		return "Error: unknown report " + report
+	}
+	if err := config.EmailImmediate(key); err != nil {
+		log.Print("ERROR: send now: ", err)
+		return "Error: " + err.Error()
+	}
+	return "The " + report + " report is being sent"
+}
+
+// Returns the form values that the settings page would submit for the current
+// config. Used by the api so that a partial update leaves other settings unchanged.
+func GetForm() url.Values {
+	vars := GetPageVariables()
+	f := url.Values{}
+	for _, s := range vars.Settings {
+		if s.Type == "checkbox" {
+			f.Set(s.Id, s.Checked)
+		} else {
+			f.Set(s.Id, s.Value)
+		}
+	}
+	for _, a := range vars.AutoEmailSettings {
+		f.Set(a.Id+"_Checked", a.Checked)
+		f.Set(a.Id+"_Count", a.Count)
+		f.Set(a.Id+"_Period", a.Period)
+		f.Set(a.Id+"_Schedule", a.Schedule)
+		f.Set(a.Id+"_CatchUp", a.CatchUp)
+	}
+	return f
+}
+
+// Validates the form values (as submitted by the settings page or the api) and if
+// they are all valid, saves them to the config. The returned page variables hold
+// the values as entered, with Errored/Description set for any that failed, and
+// the SuccessMessage set if the config was updated.
+func ApplyForm(form url.Values) (SettingsPageVariables, bool) {
+	settingsPageVars, c, success := validateForm(form)
+	if success {
+		// If all the settings are valid, then update the configuration.
+		if err := config.Set(c); err == nil {
+			settingsPageVars.SuccessMessage = "Settings updated successfully"
+			// Only now that the config is saved will the goroutines see the new values.
+			config.Broadcast()
+		} else {
+			settingsPageVars.SuccessMessage = "Error saving config: " + err.Error()
+			success = false
+		}
+	}
+	return settingsPageVars, success
+}
+
+// Tests the connection to the email server with the form values (which need not have
+// been saved), without sending any mail. The config is not changed.
+func TestSmtpForm(form url.Values) SettingsPageVariables {
+	settingsPageVars, c, success := validateForm(form)
+	if !success {
+		settingsPageVars.SmtpTest = []string{"not tested: the settings have errors"}
+		settingsPageVars.SmtpTestErrored = "errored"
+		return settingsPageVars
+	}
+	steps, err := notify.TestSmtp(c)
+	if err != nil {
+		log.Print("ERROR: email connection test: ", err)
+		settingsPageVars.SmtpTestErrored = "errored"
+	}
+	settingsPageVars.SmtpTest = steps
+	return settingsPageVars
+}
+
+// Validates the form values into a copy of the config, returning the page variables
+// (as for ApplyForm), the copy, and whether they were all valid. The validators change
+// only the copy, since a test (see TestSmtpForm) saves nothing; the goroutines are told
+// of the changes by ApplyForm once they are saved.
+func validateForm(form url.Values) (SettingsPageVariables, config.Configuration, bool) {
+	settingsPageVars := GetPageVariables()
+	c := config.Get() // Use a temp local configuration
+	success := true
+	for s := 0; s < len(settingsPageVars.Settings); s++ {
+		setting := &settingsPageVars.Settings[s]
+		// Only check writeable settings.
+		// If there is a new value for the setting in the form, then store it in
+		// the setting (where it can be sent back to the page) and validate it,
+		// updating the local config with the new value. Indicate an error by
+		// placing error details in the Description field and setting Errored flag.
+		if !setting.Readonly {
+			// could also use "if val, ok := m[key]; ok" to test for contains
+			// fmt.Printf("===> USING form value '%s' for key %s\n", setting.Value, setting.Id)
+			if err := setting.Validator(form, &c, setting); err != nil {
+				setting.Description = err.Error()
+				setting.Errored = "errored"
+				success = false
+			}
+		}
+		// fmt.Printf("setting after validating ==> %v\n", setting)
+	}
+	for a := 0; a < len(settingsPageVars.AutoEmailSettings); a++ {
+		auto := &settingsPageVars.AutoEmailSettings[a]
+		if err := auto.Validator(form, auto, &c); err != nil {
+			auto.Description = err.Error()
+			auto.Errored = "errored"
+			success = false
+		}
+	}
+	c.SyncFolders = compactFolders(c.SyncFolders)
+	c.Sources = compactSources(c.Sources)
+	c.Recipients = compactRecipients(c.Recipients)
+	if success {
+		// The settings are each valid, but the config as a whole must also pass the
+		// checks made when it is loaded, or it could not be used after a restart.
+		var errs []string
+		for _, p := range config.Validate(c) {
+			if p.Warning {
+				continue
+			}
+			errs = append(errs, p.String())
+			for s := 0; s < len(settingsPageVars.Settings); s++ {
+				if setting := &settingsPageVars.Settings[s]; setting.Id == p.Field {
+					setting.Description = p.Message
+					setting.Errored = "errored"
+				}
+			}
+		}
+		if len(errs) > 0 {
+			settingsPageVars.SuccessMessage = "Not saved: " + strings.Join(errs, "; ")
+			success = false
+		}
+	}
+	// fmt.Printf("config after validating ==> %v\n", config)
+	return settingsPageVars, c, success
+}
@@ -0,0 +1,103 @@
+package settings
+
+import (
+	"net/url"
+	"reporter/config"
+	"testing"
+)
+
+// Runs the validator of the setting with the id on the form value, returning the
+// config as changed by it.
+func validateSetting(t *testing.T, c config.Configuration, id, value string) (config.Configuration, error) {
+	for _, s := range getSettings(c) {
+		if s.Id == id {
+			err := s.Validator(url.Values{id: {value}}, &c, &s)
+			return c, err
+		}
+	}
+	t.Fatalf("no setting %s", id)
+	return c, nil
+}
+
+func TestAlertCheckPeriod(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+		want  int
+	}{
+		{"0", true, 0}, // The default, as in a migrated or sample config
+		{"10", true, 10},
+		{"300", true, 300},
+		{"9", false, 60},
+		{"-1", false, 60},
+		{"soon", false, 60},
+	}
+	for _, test := range tests {
+		c, err := validateSetting(t, config.Configuration{AlertCheckPeriod: 60}, "AlertCheckPeriod", test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("AlertCheckPeriod %q: got %v, expected valid %v", test.value, err, test.valid)
+		}
+		if c.AlertCheckPeriod != test.want {
+			t.Errorf("AlertCheckPeriod %q: set %d, expected %d", test.value, c.AlertCheckPeriod, test.want)
+		}
+	}
+}
+
+func TestSourceFileWatchPeriod(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+		want  int
+	}{
+		{"0", true, 0},  // The default, as in the sample config
+		{"5", true, 10}, // Raised to the watcher's minimum
+		{"10", true, 10},
+		{"60", true, 60},
+		{"-5", false, 30},
+		{"", false, 30},
+	}
+	for _, watch := range []bool{false, true} {
+		for _, test := range tests {
+			in := config.Configuration{EnableSourceFileWatch: watch, SourceFileWatchPeriod: 30}
+			c, err := validateSetting(t, in, "SourceFileWatchPeriod", test.value)
+			if (err == nil) != test.valid {
+				t.Errorf("SourceFileWatchPeriod %q (watch %v): got %v, expected valid %v", test.value, watch, err, test.valid)
+			}
+			if c.SourceFileWatchPeriod != test.want {
+				t.Errorf("SourceFileWatchPeriod %q (watch %v): set %d, expected %d", test.value, watch, c.SourceFileWatchPeriod, test.want)
+			}
+		}
+	}
+}
+
+// An empty value keeps the secret, unless it is to be cleared.
+func TestSecretSetting(t *testing.T) {
+	tests := []struct {
+		form  url.Values
+		want  string
+		isSet bool
+	}{
+		{url.Values{"EmailPassword": {""}}, "old", true},
+		{url.Values{}, "old", true},
+		{url.Values{"EmailPassword": {"new"}}, "new", true},
+		{url.Values{"EmailPassword": {"new"}, "EmailPassword_Clear": {"checked"}}, "new", true},
+		{url.Values{"EmailPassword": {""}, "EmailPassword_Clear": {"checked"}}, "", false},
+	}
+	for _, test := range tests {
+		c := config.Configuration{EmailPassword: "old"}
+		for _, s := range getSettings(c) {
+			if s.Id != "EmailPassword" {
+				continue
+			}
+			if s.Value != "" || !s.IsSet {
+				t.Errorf("the page has %q, IsSet %v; expected no value, and set", s.Value, s.IsSet)
+			}
+			if err := s.Validator(test.form, &c, &s); err != nil {
+				t.Errorf("%v: %s", test.form, err)
+			}
+			if c.EmailPassword != test.want || s.IsSet != test.isSet {
+				t.Errorf("%v: got %q, IsSet %v; expected %q, %v", test.form, c.EmailPassword, s.IsSet, test.want, test.isSet)
+			}
+		}
+	}
+}
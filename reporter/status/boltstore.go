@@ -0,0 +1,165 @@
+package status
+
+// Ref: https://github.com/etcd-io/bbolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	historyBucket = []byte("history")
+	metaBucket    = []byte("meta")
+	importedKey   = []byte("imported") // The HistoryFile that was imported, and when
+)
+
+// Records are keyed by their ServerTime (unix seconds) then a sequence number, both
+// big-endian so that the keys sort by time.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// Opens (creating if needed) the database at path. If the database has not yet imported
+// a history file, then the records of the historyFile (if any) are imported.
+func openBoltStore(path, historyFile string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err == nil {
+		err = s.importHistoryFile(historyFile)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// A one time import of the records from the json lines history file, which is left in place.
+func (s *boltStore) importHistoryFile(historyFile string) error {
+	imported := false
+	s.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(metaBucket).Get(importedKey) != nil
+		return nil
+	})
+	if imported || historyFile == "" {
+		return nil
+	}
+	if _, err := os.Stat(historyFile); os.IsNotExist(err) {
+		return nil
+	}
+	records, err := readHistoryFile(historyFile)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		for _, r := range records {
+			if err := put(bucket, r); err != nil {
+				return err
+			}
+		}
+		note := historyFile + " at " + time.Now().Format(time.RFC3339)
+		return tx.Bucket(metaBucket).Put(importedKey, []byte(note))
+	})
+	if err == nil {
+		log.Printf("history store: imported %d records from %s\n", len(records), historyFile)
+	}
+	return err
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(key, uint64(t.Unix()))
+	}
+	return key
+}
+
+func put(bucket *bolt.Bucket, record BackupStatus) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	copy(key, timeKey(recordTime(record)))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return bucket.Put(key, value)
+}
+
+func (s *boltStore) Append(record BackupStatus) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(historyBucket), record)
+	})
+}
+
+// Calls f for each record (and its key) with a ServerTime in the range.
+func (s *boltStore) each(tx *bolt.Tx, from, to time.Time, f func(key []byte, record BackupStatus)) error {
+	c := tx.Bucket(historyBucket).Cursor()
+	toKey := timeKey(to)
+	for k, v := c.Seek(timeKey(from)); k != nil; k, v = c.Next() {
+		if !to.IsZero() && string(k[:8]) >= string(toKey) {
+			break
+		}
+		record := BackupStatus{}
+		if err := json.Unmarshal(v, &record); err != nil {
+			log.Printf("ERROR: skipping history record %s: %s\n", v, err)
+			continue
+		}
+		f(k, record)
+	}
+	return nil
+}
+
+func (s *boltStore) Query(from, to time.Time) ([]BackupStatus, error) {
+	var records []BackupStatus
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.each(tx, from, to, func(key []byte, record BackupStatus) {
+			records = append(records, record)
+		})
+	})
+	return records, err
+}
+
+func (s *boltStore) Prune(before time.Time, keep func(record BackupStatus) bool) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Deleting while iterating with a cursor can skip records, so collect the keys first.
+		var keys [][]byte
+		s.each(tx, time.Time{}, before, func(key []byte, record BackupStatus) {
+			if !keep(record) {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+		})
+		bucket := tx.Bucket(historyBucket)
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return removed, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,133 @@
+package status
+
+// Simple line charts of the history, rendered as inline svg so that they need no scripts
+// and can be shown in the HISTORY email as well as the page.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strconv"
+	"time"
+)
+
+const (
+	RANGE_DAY   = "day"
+	RANGE_WEEK  = "week"
+	RANGE_MONTH = "month"
+	RANGE_ALL   = "all"
+
+	CHART_WIDTH  = 600
+	CHART_HEIGHT = 150
+	CHART_MARGIN = 40 // Around the plot, for the labels
+)
+
+var Ranges = []string{RANGE_DAY, RANGE_WEEK, RANGE_MONTH, RANGE_ALL}
+
+// Returns the start of the named range, ending now; or the zero time for all (or an unknown range).
+func RangeStart(name string, now time.Time) time.Time {
+	switch name {
+	case RANGE_DAY:
+		return now.AddDate(0, 0, -1)
+	case RANGE_WEEK:
+		return now.AddDate(0, 0, -7)
+	case RANGE_MONTH:
+		return now.AddDate(0, -1, 0)
+	}
+	return time.Time{}
+}
+
+// Returns the charts for a source's history: missing files and bytes, the source age, and
+// the backed up totals.
+func SourceCharts(history []BackupStatus) []template.HTML {
+	var times []time.Time
+	var missingFiles, missingBytes, ages, files, fileBytes []float64
+	for _, r := range history {
+		t := recordTime(r)
+		if t.IsZero() || r.Error != "" {
+			continue // The values of a failed status are not meaningful
+		}
+		times = append(times, t)
+		missingFiles = append(missingFiles, float64(r.MissingFiles))
+		missingBytes = append(missingBytes, float64(r.MissingBytes))
+		files = append(files, float64(r.BackedUpFiles))
+		fileBytes = append(fileBytes, float64(r.BackedUpBytes))
+		age, _ := time.ParseDuration(r.SourceAge) // As written by ShortenTimeDiff
+		ages = append(ages, age.Hours())
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	return []template.HTML{
+		Chart("Missing Files", times, missingFiles),
+		Chart("Missing Bytes", times, missingBytes),
+		Chart("Source Age (hours)", times, ages),
+		Chart("Backed Up Files", times, files),
+		Chart("Backed Up Bytes", times, fileBytes),
+	}
+}
+
+// Returns an svg line chart of the values over the times (which are in order). The y axis
+// runs from the lowest of zero and the minimum value, to the maximum value.
+func Chart(title string, times []time.Time, values []float64) template.HTML {
+	minY, maxY := 0.0, 0.0
+	for _, v := range values {
+		if v < minY {
+			minY = v
+		}
+		if v > maxY {
+			maxY = v
+		}
+	}
+	if maxY == minY {
+		maxY = minY + 1
+	}
+	start, end := times[0], times[len(times)-1]
+	span := end.Sub(start).Seconds()
+	plotWidth := float64(CHART_WIDTH - 2*CHART_MARGIN)
+	plotHeight := float64(CHART_HEIGHT - 2*CHART_MARGIN)
+	x := func(t time.Time) float64 {
+		if span == 0 {
+			return CHART_MARGIN + plotWidth/2
+		}
+		return CHART_MARGIN + plotWidth*t.Sub(start).Seconds()/span
+	}
+	y := func(v float64) float64 {
+		return CHART_MARGIN + plotHeight*(maxY-v)/(maxY-minY)
+	}
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="monospace" font-size="11">`,
+		CHART_WIDTH, CHART_HEIGHT, CHART_WIDTH, CHART_HEIGHT)
+	fmt.Fprintf(&svg, `<text x="%d" y="%d" font-size="13">%s</text>`, CHART_MARGIN, CHART_MARGIN-20, template.HTMLEscapeString(title))
+	// Axes, with the y range and the x (time) range as labels.
+	fmt.Fprintf(&svg, `<path d="M%d %d V%d H%d" fill="none" stroke="#999"/>`,
+		CHART_MARGIN, CHART_MARGIN, CHART_HEIGHT-CHART_MARGIN, CHART_WIDTH-CHART_MARGIN)
+	fmt.Fprintf(&svg, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, CHART_MARGIN-4, y(maxY)+4, formatValue(maxY))
+	fmt.Fprintf(&svg, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, CHART_MARGIN-4, y(minY)+4, formatValue(minY))
+	fmt.Fprintf(&svg, `<text x="%d" y="%d">%s</text>`, CHART_MARGIN, CHART_HEIGHT-CHART_MARGIN+15, start.Format(REPORT_TIME_FORMAT[:16]))
+	fmt.Fprintf(&svg, `<text x="%d" y="%d" text-anchor="end">%s</text>`, CHART_WIDTH-CHART_MARGIN, CHART_HEIGHT-CHART_MARGIN+15, end.Format(REPORT_TIME_FORMAT[:16]))
+	if len(values) == 1 {
+		fmt.Fprintf(&svg, `<circle cx="%.1f" cy="%.1f" r="3" fill="#0078e7"/>`, x(times[0]), y(values[0]))
+	} else {
+		svg.WriteString(`<polyline fill="none" stroke="#0078e7" stroke-width="2" points="`)
+		for i, v := range values {
+			fmt.Fprintf(&svg, "%.1f,%.1f ", x(times[i]), y(v))
+		}
+		svg.WriteString(`"/>`)
+	}
+	svg.WriteString("</svg>")
+	return template.HTML(svg.String())
+}
+
+// Formats the value with a K, M, G or T suffix if it is large.
+func formatValue(v float64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   float64
+	}{{"T", 1e12}, {"G", 1e9}, {"M", 1e6}, {"K", 1e3}} {
+		if v >= unit.size || v <= -unit.size {
+			return strconv.FormatFloat(v/unit.size, 'f', 1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
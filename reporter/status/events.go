@@ -0,0 +1,248 @@
+package status
+
+// Follows the syncthing event stream, so that the latest snapshot (see poller.go) is kept
+// current between polls. The events are fetched by long-polling /rest/events on the same
+// server as SyncApiEndpoint, resuming after the last event seen (since=).
+// Ref: https://docs.syncthing.net/dev/events.html
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reporter/config"
+	"strconv"
+	"time"
+)
+
+const (
+	EVENTS_PATH    = "/rest/events"
+	EVENTS_TYPES   = "FolderSummary,StateChanged,FolderErrors,ItemFinished"
+	EVENTS_TIMEOUT = 60 // Seconds that syncthing holds each request open, when there are no events
+	EVENTS_RETRY   = 30 // Seconds to wait after an error, before trying again
+)
+
+// An event as returned by syncthing; the Data depends on the Type.
+type SyncthingEvent struct {
+	Id   int
+	Type string
+	Time string
+	Data json.RawMessage
+}
+
+type folderSummaryData struct {
+	Folder  string
+	Summary SyncthingStatus
+}
+
+type stateChangedData struct {
+	Folder string
+	From   string
+	To     string
+}
+
+type folderErrorsData struct {
+	Folder string
+	Errors []struct {
+		Error string
+		Path  string
+	}
+}
+
+type itemFinishedData struct {
+	Folder string
+	Item   string
+	Action string
+	Error  *string
+}
+
+// The result of one request for events.
+type eventsResult struct {
+	events []SyncthingEvent
+	err    error
+}
+
+// Follows the event stream while EnableSyncEvents is set. The channel is used to alert the
+// subscriber that the config has changed and to re-load it.
+func EventSubscriber(control <-chan config.ControlMsg, key int) {
+	tag := fmt.Sprintf("EventSubscriber(%s)", config.KeyName[key])
+	log.Printf("%s: starting\n", tag)
+	since := 0
+	primed := false // Whether the backlog (the first batch) has been skipped
+	for {
+		if !config.Get().EnableSyncEvents {
+			log.Printf("%s: disabled, waiting indefinitely...\n", tag)
+			msg := <-control
+			log.Printf("%s: msg: %s\n", tag, config.MsgName[msg])
+			continue
+		}
+		// The request is made in the background, so that a config change can interrupt it.
+		ctx, cancel := context.WithCancel(context.Background())
+		results := make(chan eventsResult, 1)
+		go func(since int) {
+			events, err := getSyncthingEvents(ctx, since)
+			results <- eventsResult{events, err}
+		}(since)
+		select {
+		case msg := <-control:
+			cancel()
+			log.Printf("%s: msg: %s\n", tag, config.MsgName[msg])
+		case result := <-results:
+			cancel()
+			if result.err != nil {
+				log.Printf("ERROR: %s: %s; retrying in %ds\n", tag, result.err, EVENTS_RETRY)
+				// Syncthing may have restarted, which restarts its event ids.
+				since = 0
+				primed = false
+				if waitControl(control, EVENTS_RETRY*time.Second) {
+					log.Printf("%s: config change occurred\n", tag)
+				}
+				continue
+			}
+			if !primed {
+				// The first batch is the backlog that syncthing has buffered (which may be
+				// empty); the snapshot is brought up to date by a poll instead.
+				if len(result.events) > 0 {
+					since = result.events[len(result.events)-1].Id
+				}
+				primed = true
+				log.Printf("%s: following events after id %d\n", tag, since)
+				Refresh()
+				continue
+			}
+			for _, event := range result.events {
+				handleEvent(tag, event)
+				since = event.Id
+			}
+		}
+	}
+}
+
+// Waits for the duration, or a control message; returns true if a message was received.
+func waitControl(control <-chan config.ControlMsg, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-control:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Applies the event to the latest snapshot. A folder that becomes idle after syncing is
+// reported (if SyncEventsAutoEmail is set) by requesting an immediate STATUS report.
+func handleEvent(tag string, event SyncthingEvent) {
+	switch event.Type {
+	case "FolderSummary":
+		var data folderSummaryData
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			log.Printf("ERROR: %s: event %d: %s\n", tag, event.Id, err)
+			return
+		}
+		updateFolder(data.Folder, true, func(st *SyncthingStatus) {
+			*st = data.Summary
+		})
+	case "StateChanged":
+		var data stateChangedData
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			log.Printf("ERROR: %s: event %d: %s\n", tag, event.Id, err)
+			return
+		}
+		log.Printf("%s: folder %s %s ==> %s\n", tag, data.Folder, data.From, data.To)
+		updateFolder(data.Folder, false, func(st *SyncthingStatus) {
+			st.State = data.To
+			st.StateChanged = event.Time
+		})
+		if data.From == "syncing" && data.To == "idle" && config.Get().SyncEventsAutoEmail {
+			// The mailer may be busy, so don't hold up the events (a report already
+			// requested will include this folder anyway).
+			select {
+			case config.MailerControl[config.KEY_STATUS] <- config.CONTROL_EMAIL_IMMEDIATE:
+			default:
+				log.Printf("%s: the %s mailer is busy; not requesting another report\n", tag, config.KeyName[config.KEY_STATUS])
+			}
+		}
+	case "FolderErrors":
+		var data folderErrorsData
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			log.Printf("ERROR: %s: event %d: %s\n", tag, event.Id, err)
+			return
+		}
+		log.Printf("%s: folder %s has %d errors\n", tag, data.Folder, len(data.Errors))
+		updateFolder(data.Folder, false, func(st *SyncthingStatus) {
+			st.PullErrors = len(data.Errors)
+		})
+	case "ItemFinished":
+		// The counts are updated by the FolderSummary that follows; only failures are logged.
+		var data itemFinishedData
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			log.Printf("ERROR: %s: event %d: %s\n", tag, event.Id, err)
+			return
+		}
+		if data.Error != nil {
+			log.Printf("ERROR: %s: folder %s %s %s: %s\n", tag, data.Folder, data.Action, data.Item, *data.Error)
+		}
+	}
+}
+
+// Returns the url of another syncthing api, on the same server as the SyncApiEndpoint.
+func SyncthingUrl(path string, query url.Values) (string, error) {
+	u, err := url.Parse(config.Get().SyncApiEndpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", errors.New("SyncApiEndpoint has no host")
+	}
+	u.Path = path
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Returns the url of the event stream.
+func eventsEndpoint(since int) (string, error) {
+	q := url.Values{}
+	q.Set("since", strconv.Itoa(since))
+	q.Set("timeout", strconv.Itoa(EVENTS_TIMEOUT))
+	q.Set("events", EVENTS_TYPES)
+	return SyncthingUrl(EVENTS_PATH, q)
+}
+
+// Returns the events after since, waiting up to EVENTS_TIMEOUT for the first one.
+func getSyncthingEvents(ctx context.Context, since int) ([]SyncthingEvent, error) {
+	endpoint, err := eventsEndpoint(since)
+	if err != nil {
+		return nil, err
+	}
+	// Allow for the request being held open by syncthing.
+	ctx, cancel := context.WithTimeout(ctx, (EVENTS_TIMEOUT+30)*time.Second)
+	defer cancel()
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("X-API-Key", config.Get().SyncApiKey)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("syncthing events: %s", response.Status)
+	}
+	var events []SyncthingEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
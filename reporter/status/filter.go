@@ -0,0 +1,189 @@
+package status
+
+// Selection of history records by query parameters, shared by the history page, its
+// csv/json downloads and the api:
+//   from, to    dates (2006-01-02) or times (2006-01-02 15:04:05); to is exclusive
+//   range       day, week, month or all; ending now (ignored if from is given)
+//   source      only the records of this source
+//   minMissing  only records with at least this many MissingFiles
+//   errors      if set (eg errors=1), only records that have an Error
+//   page        1 is the most recent pageSize records, 2 the ones before, etc
+//   pageSize    records per page [100 on the page; 0 for all]
+// Test:  curl -s 'http://localhost:8090/history.csv?from=2019-02-01&minMissing=1'
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reporter/config"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 100
+)
+
+type HistoryFilter struct {
+	From       time.Time // Zero for unbounded
+	To         time.Time // Zero for unbounded
+	Source     string
+	MinMissing int // Only applies if HasMin
+	HasMin     bool
+	ErrorsOnly bool
+	Page       int // From 1, counting back from the most recent
+	PageSize   int // Zero for all
+}
+
+// Parses the filter from the query parameters (see above). The pageSize defaults to
+// defaultPageSize.
+func ParseHistoryFilter(q url.Values, defaultPageSize int) (HistoryFilter, error) {
+	f := HistoryFilter{Page: 1, PageSize: defaultPageSize, Source: q.Get("source")}
+	var err error
+	now := time.Now()
+	if from := q.Get("from"); from != "" {
+		if f.From, err = parseFilterTime(from); err != nil {
+			return f, errors.New("bad from: " + from)
+		}
+	} else {
+		f.From = RangeStart(q.Get("range"), now)
+	}
+	if to := q.Get("to"); to != "" {
+		if f.To, err = parseFilterTime(to); err != nil {
+			return f, errors.New("bad to: " + to)
+		}
+	}
+	if min := q.Get("minMissing"); min != "" {
+		if f.MinMissing, err = strconv.Atoi(min); err != nil {
+			return f, errors.New("bad minMissing: " + min)
+		}
+		f.HasMin = true
+	}
+	f.ErrorsOnly = q.Get("errors") != "" && q.Get("errors") != "0"
+	if page := q.Get("page"); page != "" {
+		if f.Page, err = strconv.Atoi(page); err != nil || f.Page < 1 {
+			return f, errors.New("bad page: " + page)
+		}
+	}
+	if pageSize := q.Get("pageSize"); pageSize != "" {
+		if f.PageSize, err = strconv.Atoi(pageSize); err != nil || f.PageSize < 0 {
+			return f, errors.New("bad pageSize: " + pageSize)
+		}
+	}
+	return f, nil
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation(config.TIME_FORMAT, value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// Returns whether the record passes the filter (other than its time, which is selected by the query).
+func (f HistoryFilter) matches(r BackupStatus) bool {
+	if f.Source != "" && r.Source != f.Source {
+		return false
+	}
+	if f.HasMin && int(r.MissingFiles) < f.MinMissing {
+		return false
+	}
+	if f.ErrorsOnly && r.Error == "" {
+		return false
+	}
+	return true
+}
+
+// Returns all the records that pass the filter (ignoring paging), in time order.
+func FilterHistory(f HistoryFilter) ([]BackupStatus, error) {
+	history, err := QueryHistory(f.From, f.To)
+	if err != nil {
+		return nil, err
+	}
+	var selected []BackupStatus
+	for _, r := range history {
+		if f.matches(r) {
+			selected = append(selected, r)
+		}
+	}
+	return selected, nil
+}
+
+// Returns the records of the filter's page (which is in time order), and the number of pages.
+func (f HistoryFilter) Paginate(records []BackupStatus) ([]BackupStatus, int) {
+	if f.PageSize == 0 || len(records) == 0 {
+		return records, 1
+	}
+	pages := (len(records) + f.PageSize - 1) / f.PageSize
+	end := len(records) - (f.Page-1)*f.PageSize
+	if end <= 0 {
+		return nil, pages
+	}
+	start := end - f.PageSize
+	if start < 0 {
+		start = 0
+	}
+	return records[start:end], pages
+}
+
+// Writes the filtered (and paged, if a page is given) records for download as csv.
+func HistoryCsvPage(w http.ResponseWriter, r *http.Request) {
+	records, err := exportRecords(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=history.csv")
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"Source", "FolderId", "ServerTime", "MissingFiles", "MissingBytes",
+		"BackedUpFiles", "BackedUpBytes", "SourceFiles", "SourceBytes", "SourceTimeStamp", "SourceAge", "Error"})
+	for _, b := range records {
+		writer.Write([]string{b.Source, b.FolderId, b.ServerTime,
+			strconv.Itoa(int(b.MissingFiles)), strconv.FormatInt(b.MissingBytes, 10),
+			strconv.Itoa(int(b.BackedUpFiles)), strconv.FormatInt(b.BackedUpBytes, 10),
+			strconv.Itoa(int(b.SourceFiles)), strconv.FormatInt(b.SourceBytes, 10),
+			b.SourceTimeStamp, b.SourceAge, b.Error})
+	}
+	writer.Flush()
+}
+
+// Writes the filtered (and paged, if a page is given) records for download as a json array.
+func HistoryJsonPage(w http.ResponseWriter, r *http.Request) {
+	records, err := exportRecords(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if records == nil {
+		records = []BackupStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=history.json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(records)
+}
+
+// As ParseHistoryFilter, but not paged unless a page is asked for; for the downloads and api.
+func ParseExportFilter(q url.Values) (HistoryFilter, error) {
+	if q.Get("page") != "" {
+		return ParseHistoryFilter(q, DEFAULT_PAGE_SIZE)
+	}
+	return ParseHistoryFilter(q, 0)
+}
+
+func exportRecords(r *http.Request) ([]BackupStatus, error) {
+	f, err := ParseExportFilter(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	records, err := FilterHistory(f)
+	if err != nil {
+		return nil, err
+	}
+	records, _ = f.Paginate(records)
+	return records, nil
+}
@@ -1,38 +1,172 @@
 package status
 
 import (
-	"bufio"
-	"encoding/json"
+	"errors"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"reporter/config"
+	"strconv"
+	"time"
 )
 
 type HistoryPageVariables struct {
 	Error       string
 	LocalServer bool
-	History     []BackupStatus
+	Filter      HistoryFilter   // Selects the records shown; the zero filter shows them all
+	Query       url.Values      // The filter's query parameters, for the form
+	Range       string          // One of Ranges, or empty if the from/to dates are used
+	RangeLinks  []Link          // For selecting the Range on the page
+	Total       int             // Records that pass the filter
+	Page        int             // Of the Filter
+	Pages       int             // Of Filter.PageSize records
+	PrevLink    string          // To the older page, if any
+	NextLink    string          // To the newer page, if any
+	CsvLink     string          // Download of the filtered records
+	JsonLink    string          // Download of the filtered records
+	History     []BackupStatus  // The records of the page, in time order
+	Sources     []SourceHistory // The same records, grouped by source machine
+}
+
+type Link struct {
+	Name    string
+	Href    string
+	Current bool
+}
+
+type SourceHistory struct {
+	Source     string
+	FolderName string // Of the folder that the source feeds
+	History    []BackupStatus
+	Charts     []template.HTML // Inline svg (see SourceCharts), of all the filtered records
+}
+
+// Group the history records by source machine, with the configured sources first (in order)
+// followed by any others that are in the history but no longer configured.
+func GroupBySource(history []BackupStatus) []SourceHistory {
+	c := config.Get()
+	var sources []SourceHistory
+	index := map[string]int{}
+	for _, s := range c.Sources {
+		index[s.Name] = len(sources)
+		sources = append(sources, SourceHistory{Source: s.Name, FolderName: folderName(c, s.FolderId)})
+	}
+	for _, record := range history {
+		i, ok := index[record.Source]
+		if !ok {
+			i = len(sources)
+			index[record.Source] = i
+			sources = append(sources, SourceHistory{Source: record.Source, FolderName: folderName(c, record.FolderId)})
+		}
+		sources[i].History = append(sources[i].History, record)
+	}
+	return sources
+}
+
+// Returns the path with the query, with the key set to the value (or removed if empty).
+// The page is reset, unless it is the key.
+func historyLink(path string, q url.Values, key, value string) string {
+	values := url.Values{}
+	for k, v := range q {
+		values[k] = v
+	}
+	if key != "page" {
+		values.Del("page")
+	}
+	if key != "" {
+		values.Del(key)
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if key == "range" {
+		values.Del("from")
+		values.Del("to")
+	}
+	if len(values) == 0 {
+		return path
+	}
+	return path + "?" + values.Encode()
+}
+
+func folderName(c config.Configuration, folderId string) string {
+	if folder, ok := c.Folder(folderId); ok {
+		return folder.Label()
+	}
+	return folderId
+}
+
+// Returns the most recent record for each source that has any history.
+func LatestBySource(history []BackupStatus) []BackupStatus {
+	var latest []BackupStatus
+	for _, source := range GroupBySource(history) {
+		if len := len(source.History); len > 0 {
+			latest = append(latest, source.History[len-1])
+		}
+	}
+	return latest
 }
 
 // Serve the history records as a page for local/connected access
 func HistoryPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
 	historyPageVariables := HistoryPageVariables{
 		LocalServer: true,
+		Query:       q,
+		Range:       q.Get("range"),
+	}
+	if q.Get("from") != "" || q.Get("to") != "" {
+		historyPageVariables.Range = ""
+	} else if historyPageVariables.Range == "" {
+		historyPageVariables.Range = RANGE_ALL
+	}
+	var err error
+	historyPageVariables.Filter, err = ParseHistoryFilter(q, DEFAULT_PAGE_SIZE)
+	if err != nil {
+		historyPageVariables.Error = err.Error()
+	}
+	for _, name := range Ranges {
+		historyPageVariables.RangeLinks = append(historyPageVariables.RangeLinks, Link{
+			Name: name, Href: historyLink("/history", q, "range", name), Current: name == historyPageVariables.Range,
+		})
 	}
+	historyPageVariables.CsvLink = historyLink("/history.csv", q, "", "")
+	historyPageVariables.JsonLink = historyLink("/history.json", q, "", "")
 	HistoryFetch(w, &historyPageVariables)
 }
 
-// Fetches all history records from the history file,
-// and writes the expanded html string to the parm.
+// Fetches the history records selected by the Filter (all by default) from the history
+// store, and writes the expanded html string (with charts) to the parm.
 // Errors are logged here.
 // Nesting: https://stackoverflow.com/questions/11467731/is-it-possible-to-have-nested-templates-in-go-using-the-standard-library-googl
 func HistoryFetch(w io.Writer, historyPageVariables *HistoryPageVariables) error {
-	history, err1 := ReadStatusHistory()
-	historyPageVariables.History = history
-	historyPageVariables.Error = err1
+	vars := historyPageVariables
+	if vars.Error == "" {
+		all, err1 := FilterHistory(vars.Filter)
+		if err1 != nil {
+			vars.Error = err1.Error()
+		}
+		vars.Total = len(all)
+		vars.Page = vars.Filter.Page
+		vars.History, vars.Pages = vars.Filter.Paginate(all)
+		if vars.LocalServer && vars.Page < vars.Pages {
+			vars.PrevLink = historyLink("/history", vars.Query, "page", strconv.Itoa(vars.Page+1))
+		}
+		if vars.LocalServer && vars.Page > 1 {
+			vars.NextLink = historyLink("/history", vars.Query, "page", strconv.Itoa(vars.Page-1))
+		}
+		// The charts are of all the records, not just the page.
+		charts := map[string][]template.HTML{}
+		for _, source := range GroupBySource(all) {
+			charts[source.Source] = SourceCharts(source.History)
+		}
+		vars.Sources = GroupBySource(vars.History)
+		for i := range vars.Sources {
+			vars.Sources[i].Charts = charts[vars.Sources[i].Source]
+		}
+	}
 	t, err2 := template.ParseFiles("status/history.html")
 	if err2 != nil {
 		log.Print("ERROR: HistoryFetch template parsing error: ", err2)
@@ -44,49 +178,56 @@ func HistoryFetch(w io.Writer, historyPageVariables *HistoryPageVariables) error
 	return nil
 }
 
+// History records written before there were multiple sources, have the source's
+// fields named after the single (acer) machine.
+type legacyBackupStatus struct {
+	BackupStatus
+	AcerFiles     int32
+	AcerBytes     int64
+	AcerTimeStamp string
+	AcerAge       string
+}
+
+// Returns all the history records, oldest first, or an error message if the store
+// could not be read.
 func ReadStatusHistory() ([]BackupStatus, string) {
-	historyPath := config.Get().HistoryFile
-	file, err := os.Open(historyPath)
+	history, err := QueryHistory(time.Time{}, time.Time{})
 	if err != nil {
-		log.Printf("ERROR: opening for read %s: %s\n", historyPath, err)
 		return nil, err.Error()
 	}
-	defer file.Close()
-	var history []BackupStatus
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		status := BackupStatus{}
-		err := json.Unmarshal([]byte(line), &status)
-		if err != nil {
-			log.Printf("ERROR: parsing history record %s: %s\n", line, err)
-			return nil, err.Error()
-		} else {
-			history = append(history, status)
-		}
-	}
 	return history, ""
 }
 
-func SaveStatusToHistory(record BackupStatus) error {
-	// TODO protect with mutex
-	line, err := json.Marshal(record)
-	if err != nil {
-		log.Printf("ERROR: marshall during SaveStatusToHistory: %s\n", err)
-		return err
+// Converts a record read from the history. Older records have no Source (and perhaps
+// no FolderId), and are attributed to the first configured source (for the folder).
+func convertLegacy(c config.Configuration, record legacyBackupStatus) BackupStatus {
+	status := record.BackupStatus
+	if status.Source == "" {
+		for _, source := range c.Sources {
+			if status.FolderId == "" || status.FolderId == source.FolderId {
+				status.Source = source.Name
+				status.FolderId = source.FolderId
+				break
+			}
+		}
+		status.SourceFiles = record.AcerFiles
+		status.SourceBytes = record.AcerBytes
+		status.SourceTimeStamp = record.AcerTimeStamp
+		status.SourceAge = record.AcerAge
 	}
-	line = append(line, '\n')
-	historyPath := config.Get().HistoryFile
-	file, err := os.OpenFile(historyPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		log.Printf("ERROR: opening during saveHiSaveStatusToHistorystoryRecord %s: %s\n", historyPath, err)
-		return err
+	return status
+}
+
+// Fetches a new BackupStatus for each source and appends them to the history, including
+// those that failed (with their Error). All the statuses are returned.
+func AppendToHistory() ([]BackupStatus, error) {
+	snapshot := Refresh()
+	for _, backupStatus := range snapshot.Statuses {
+		SaveStatusToHistory(backupStatus)
 	}
-	defer file.Close()
-	_, err = file.Write(line)
-	if err != nil {
-		log.Printf("ERROR: write during SaveStatusToHistory: %s\n", err)
-		return err
+	var err error
+	if snapshot.Error != "" {
+		err = errors.New(snapshot.Error)
 	}
-	return nil
+	return snapshot.Statuses, err
 }
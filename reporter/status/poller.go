@@ -0,0 +1,127 @@
+package status
+
+// A single background poller fetches the BackupStatuses every StatusPollPeriod, and keeps
+// the latest in memory, so that the pages, api and reports don't each re-read the source
+// files and call syncthing. Refresh can be called to poll on demand.
+
+import (
+	"fmt"
+	"log"
+	"reporter/config"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_POLL_PERIOD = 60 // Seconds, when StatusPollPeriod is not set
+	MIN_POLL_PERIOD     = 10 // Seconds
+)
+
+// The result of one poll of all the sources.
+type Snapshot struct {
+	Statuses []BackupStatus // One per Source, each with its own Error
+	Error    string         // The combined error of the poll (see GetBackupStatuses)
+	Time     string         // When the poll was made, in config.TIME_FORMAT
+}
+
+var latest Snapshot
+var latestMutex = &sync.Mutex{}  // Guards latest
+var refreshMutex = &sync.Mutex{} // Allows only one poll at a time
+
+// Returns (a copy of) the latest snapshot. If there has not yet been a poll, then one is made.
+func Latest() Snapshot {
+	latestMutex.Lock()
+	snapshot := latest
+	latestMutex.Unlock()
+	if snapshot.Time == "" {
+		return Refresh()
+	}
+	snapshot.Statuses = append([]BackupStatus(nil), snapshot.Statuses...)
+	return snapshot
+}
+
+// Polls all the sources now, replacing the latest snapshot, which is returned.
+func Refresh() Snapshot {
+	refreshMutex.Lock()
+	defer refreshMutex.Unlock()
+	snapshot := Snapshot{Time: time.Now().Format(config.TIME_FORMAT)}
+	statuses, err := GetBackupStatuses()
+	snapshot.Statuses = statuses
+	if err != nil {
+		snapshot.Error = err.Error()
+	}
+	latestMutex.Lock()
+	latest = snapshot
+	latestMutex.Unlock()
+	snapshot.Statuses = append([]BackupStatus(nil), statuses...)
+	return snapshot
+}
+
+// Applies the change to the syncthing status of the folder in the latest snapshot, and
+// re-compares each source that feeds it. Unless the change is complete (replaces the
+// whole status), sources without a syncthing status (ie that failed) are left as they are.
+// Does nothing before the first poll.
+func updateFolder(folderId string, complete bool, change func(st *SyncthingStatus)) {
+	latestMutex.Lock()
+	defer latestMutex.Unlock()
+	if latest.Time == "" {
+		return
+	}
+	c := config.Get()
+	var updated *SyncthingStatus
+	statuses := append([]BackupStatus(nil), latest.Statuses...)
+	for i, s := range statuses {
+		if s.FolderId != folderId || (s.Syncthing == nil && !complete) {
+			continue
+		}
+		source, ok := c.Source(s.Source)
+		if !ok {
+			continue
+		}
+		if updated == nil {
+			updated = &SyncthingStatus{}
+			if s.Syncthing != nil {
+				*updated = *s.Syncthing
+			}
+			change(updated)
+		}
+		backupStatus, _ := compare(source, updated, nil)
+		statuses[i] = *backupStatus
+	}
+	if updated == nil {
+		return
+	}
+	var errText string
+	for _, s := range statuses {
+		if s.Error != "" {
+			if len(errText) > 0 {
+				errText = errText + "; "
+			}
+			errText = errText + s.Source + ": " + s.Error
+		}
+	}
+	latest = Snapshot{Statuses: statuses, Error: errText, Time: time.Now().Format(config.TIME_FORMAT)}
+}
+
+// Polls every StatusPollPeriod seconds. The channel is used to alert the poller that
+// the config has changed and to re-load it.
+func Poller(control <-chan config.ControlMsg, key int) {
+	tag := fmt.Sprintf("Poller(%s)", config.KeyName[key])
+	log.Printf("%s: starting\n", tag)
+	for {
+		Refresh()
+		secs := config.Get().StatusPollPeriod
+		if secs == 0 {
+			secs = DEFAULT_POLL_PERIOD
+		} else if secs < MIN_POLL_PERIOD {
+			secs = MIN_POLL_PERIOD
+		}
+		timer := time.NewTimer(time.Duration(secs) * time.Second)
+		select {
+		case msg := <-control:
+			log.Printf("%s: msg: %s\n", tag, config.MsgName[msg])
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
@@ -8,30 +8,41 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"reporter/config"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	ACER_TIME_FORMAT   = "03:04 PM, Mon 02/01/2006 MST" // As found on AcerDataFile
-	REPORT_TIME_FORMAT = "2006-01-02 15:04:00"          // As written to reports
+	SOURCE_TIME_FORMAT      = "03:04 PM, Mon 02/01/2006"     // As found on the source status file
+	SOURCE_TIME_ZONE_FORMAT = "03:04 PM, Mon 02/01/2006 MST" // As above, with a zone abbreviation
+	REPORT_TIME_FORMAT      = "2006-01-02 15:04:00"          // As written to reports
+	SYNC_API_TIMEOUT        = 15 * time.Second               // For a folder status from syncthing
 )
 
-// Represents the dfference between an AcerStatus and a SyncthingStatus
+// Represents the dfference between a SourceStatus and the SyncthingStatus of the folder it feeds
 type BackupStatus struct {
-	ServerTime    string // Also the timestamp for this record
-	MissingFiles  int32  // BackedUp/Acer diff
-	MissingBytes  int64  // BackedUp/Acer diff
-	BackedUpFiles int32  // Syncthing.localFiles
-	BackedUpBytes int64  // Syncthing.localBytes
-	AcerFiles     int32
-	AcerBytes     int64
-	AcerTimeStamp string
-	AcerAge       string // How long after ServerTime is the AcerTimeStamp expressed as ddd:hh:mm
+	Source          string // Which of the Sources (machines) this record is for
+	FolderId        string // Which of the SyncFolders the source feeds
+	ServerTime      string // Also the timestamp for this record
+	MissingFiles    int32  // BackedUp/Source diff
+	MissingBytes    int64  // BackedUp/Source diff
+	BackedUpFiles   int32  // Syncthing.localFiles
+	BackedUpBytes   int64  // Syncthing.localBytes
+	SourceFiles     int32
+	SourceBytes     int64
+	SourceTimeStamp string
+	SourceAge       string // How long after ServerTime is the SourceTimeStamp expressed as ddd:hh:mm
+	Error           string `json:",omitempty"` // Why this record is only partially populated
+
+	Syncthing *SyncthingStatus `json:"-"` // Of the folder, as fetched; not kept in the history
 }
 
-type AcerStatus struct {
+// The contents of a status report file, written by a source machine.
+type SourceStatus struct {
 	Title      string
 	DateString string
 	TimeString string
@@ -72,53 +83,103 @@ type SyncthingStatus struct {
 	Version           int
 }
 
-// Return a new current BackupStatus, using the current contents of the AcerFile, and a fresh
-// call to the Syncthng API. The freshness of the AcerFile will be indicated by the AcerAge.
-// If an error occurs, it is logged here, and a partially populated BackupStatus is returned.
-// Missing counts will be -1 to indicate an error with either or both the get calls.
-func GetBackupStatus() (*BackupStatus, error) {
+// Return a new current BackupStatus for each of the Sources, in the configured order.
+// Each record has its own Error (see GetBackupStatus), and the returned error combines
+// them all, prefixed by the source name, or is nil if every source was fetched OK.
+// The syncthing status of a folder is fetched once, no matter how many sources feed it.
+func GetBackupStatuses() ([]BackupStatus, error) {
+	var statuses []BackupStatus
+	var errText string
+	c := config.Get()
+	if len(c.Sources) == 0 {
+		return nil, errors.New("no Sources configured")
+	}
+	syncthingStatuses := map[string]*SyncthingStatus{}
+	syncthingErrors := map[string]error{}
+	for _, source := range c.Sources {
+		if _, ok := syncthingStatuses[source.FolderId]; !ok {
+			syncthingStatuses[source.FolderId], syncthingErrors[source.FolderId] = GetSyncthingStatus(source.FolderId)
+		}
+		backupStatus, err := compare(source, syncthingStatuses[source.FolderId], syncthingErrors[source.FolderId])
+		if err != nil {
+			if len(errText) > 0 {
+				errText = errText + "; "
+			}
+			errText = errText + source.Name + ": " + err.Error()
+		}
+		statuses = append(statuses, *backupStatus)
+	}
+	var err error
+	if len(errText) > 0 {
+		err = errors.New(errText)
+	}
+	return statuses, err
+}
+
+// Return a new current BackupStatus for the source, using the current contents of its status
+// file, and a fresh call to the Syncthng API. The freshness of the status file will be
+// indicated by the SourceAge.
+func GetBackupStatus(source config.Source) (*BackupStatus, error) {
+	syncthingStatus, err := GetSyncthingStatus(source.FolderId)
+	return compare(source, syncthingStatus, err)
+}
+
+// Compare the source's status file against the syncthing status (or error) of its folder.
+// If an error occurs, it is logged here, and a partially populated BackupStatus is returned,
+// with the Error field also set. Missing counts will be -1 to indicate an error with either or
+// both the get calls.
+func compare(source config.Source, syncthingStatus *SyncthingStatus, err1 error) (*BackupStatus, error) {
 	var errText string
-	backupStatus := BackupStatus{}
+	backupStatus := BackupStatus{Source: source.Name, FolderId: source.FolderId}
 	serverTime := time.Now()
 	backupStatus.ServerTime = serverTime.Format(REPORT_TIME_FORMAT)
 
-	syncthingStatus, err1 := GetSyncthingStatus()
 	if err1 != nil {
 		errText = err1.Error()
 	} else {
 		// fmt.Printf("syncthingStatus ==> %v\n", syncthingStatus)
+		backupStatus.Syncthing = syncthingStatus
 		backupStatus.BackedUpFiles = syncthingStatus.LocalFiles
 		backupStatus.BackedUpBytes = syncthingStatus.LocalBytes
 	}
-	acerStatus, err2 := GetAcerStatus()
+	sourceStatus, err2 := GetSourceStatus(source.StatusFilePath)
 	if err2 != nil {
 		errText = errText + " + " + err2.Error()
 	} else {
-		// fmt.Printf("acerStatus ==> %v\n", acerStatus)
-		backupStatus.AcerFiles = acerStatus.FileCount
-		backupStatus.AcerBytes = acerStatus.ByteCount
-		backupStatus.AcerTimeStamp = acerStatus.TimeString + ", " + acerStatus.DateString + " " + config.Get().AcerTimeZone
+		// fmt.Printf("sourceStatus ==> %v\n", sourceStatus)
+		backupStatus.SourceFiles = sourceStatus.FileCount
+		backupStatus.SourceBytes = sourceStatus.ByteCount
+		backupStatus.SourceTimeStamp = sourceStatus.TimeString + ", " + sourceStatus.DateString + " " + source.TimeZone
 		if err1 == nil {
-			backupStatus.MissingFiles = backupStatus.AcerFiles - backupStatus.BackedUpFiles
-			backupStatus.MissingBytes = backupStatus.AcerBytes - backupStatus.BackedUpBytes
-			// The AcerTimeString as read from the file, is parsed and then reformatted nicely.
-			acerTime, err3 := parseAcerTimeStamp(backupStatus.AcerTimeStamp)
+			backupStatus.MissingFiles = backupStatus.SourceFiles - backupStatus.BackedUpFiles
+			backupStatus.MissingBytes = backupStatus.SourceBytes - backupStatus.BackedUpBytes
+			// The time string as read from the file, is parsed and then reformatted nicely.
+			sourceTime, err3 := parseSourceTimeStamp(sourceStatus.TimeString+", "+sourceStatus.DateString, source.TimeZone)
 			if err3 != nil {
 				errText = errText + " + " + err3.Error()
 			} else {
-				backupStatus.AcerTimeStamp = acerTime.Format(REPORT_TIME_FORMAT)
-				diff := serverTime.Sub(*acerTime)
-				backupStatus.AcerAge = ShortenTimeDiff(diff.String())
+				backupStatus.SourceTimeStamp = sourceTime.Format(REPORT_TIME_FORMAT)
+				diff := serverTime.Sub(*sourceTime)
+				backupStatus.SourceAge = ShortenTimeDiff(diff.String())
 			}
 		}
 	}
 	var err error
 	if len(errText) > 0 {
 		err = errors.New(errText)
+		backupStatus.Error = errText
 	}
 	return &backupStatus, err
 }
 
+// Returns a one line summary of the status, for use in report subjects.
+func (b BackupStatus) Summary() string {
+	if b.Error != "" {
+		return b.Source + " FAILED"
+	}
+	return b.Source + " MISSING(" + strconv.Itoa(int(b.MissingFiles)) + ") AGE(" + b.SourceAge + ")"
+}
+
 func ShortenTimeDiff(duration string) string {
 	// Truncate after the 'm'
 	for i, r := range duration {
@@ -129,17 +190,16 @@ func ShortenTimeDiff(duration string) string {
 	return duration
 }
 
-// Read the file contents at AcerStatusPath and create a corresponding AcerStatus
+// Read the file contents at statusFilePath and create a corresponding SourceStatus
 // If an error occurs, it is logged here
-func GetAcerStatus() (*AcerStatus, error) {
-	acerFilePath := config.Get().AcerFilePath
-	file, err := os.Open(acerFilePath)
+func GetSourceStatus(statusFilePath string) (*SourceStatus, error) {
+	file, err := os.Open(statusFilePath)
 	if err != nil {
-		log.Printf("ERROR: opening for read %s: %s\n", acerFilePath, err)
+		log.Printf("ERROR: opening for read %s: %s\n", statusFilePath, err)
 		return nil, err
 	}
 	defer file.Close()
-	acerStatus := AcerStatus{
+	sourceStatus := SourceStatus{
 		FileCount: -1, ByteCount: -1,
 	}
 	var builder bytes.Buffer
@@ -147,12 +207,12 @@ func GetAcerStatus() (*AcerStatus, error) {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if len(acerStatus.Title) == 0 {
-			acerStatus.Title = line
-		} else if len(acerStatus.DateString) == 0 {
-			acerStatus.DateString = line
-		} else if len(acerStatus.TimeString) == 0 {
-			acerStatus.TimeString = line
+		if len(sourceStatus.Title) == 0 {
+			sourceStatus.Title = line
+		} else if len(sourceStatus.DateString) == 0 {
+			sourceStatus.DateString = line
+		} else if len(sourceStatus.TimeString) == 0 {
+			sourceStatus.TimeString = line
 		} else {
 			builder.WriteString(line)
 		}
@@ -161,35 +221,61 @@ func GetAcerStatus() (*AcerStatus, error) {
 	syncthingStatus := SyncthingStatus{}
 	err = json.Unmarshal([]byte(stringData), &syncthingStatus)
 	if err != nil {
-		log.Printf("ERROR: AcerFile json.Unmarshal: %s\n", err)
-		log.Printf("ERROR: AcerFile api response: " + stringData)
+		log.Printf("ERROR: StatusFile json.Unmarshal: %s\n", err)
+		log.Printf("ERROR: StatusFile api response: " + stringData)
 		syncthingStatus.LocalFiles = -1
 		syncthingStatus.LocalBytes = -1
 		return nil, err
 	}
-	acerStatus.FileCount = syncthingStatus.LocalFiles
-	acerStatus.ByteCount = syncthingStatus.LocalBytes
+	sourceStatus.FileCount = syncthingStatus.LocalFiles
+	sourceStatus.ByteCount = syncthingStatus.LocalBytes
 	// TODO check all fields were present in the input file
-	return &acerStatus, nil
+	return &sourceStatus, nil
 }
 
-// The date/time string read from the acer status file is like
-// "03:04 PM, Mon 02/01/2006 MST"
-// Parse this into a golang time struct, for use in comparison
-func parseAcerTimeStamp(acerDateTime string) (*time.Time, error) {
-	time, err := time.Parse(ACER_TIME_FORMAT, acerDateTime)
+// The date/time string read from a source status file is like "03:04 PM, Mon 02/01/2006"
+// Parse this into a golang time struct, for use in comparison. The timeZone is either a
+// zone name (like "Australia/Sydney") or an abbreviation (like "AEDT"). An abbreviation
+// is only given its correct offset if it is used by the server's local zone. If there is
+// no timeZone then the server's local zone is used.
+func parseSourceTimeStamp(sourceDateTime, timeZone string) (*time.Time, error) {
+	if timeZone == "" {
+		timeZone = "Local"
+	}
+	var t time.Time
+	var err error
+	if loc, locErr := time.LoadLocation(timeZone); locErr == nil {
+		t, err = time.ParseInLocation(SOURCE_TIME_FORMAT, sourceDateTime, loc)
+	} else {
+		t, err = time.Parse(SOURCE_TIME_ZONE_FORMAT, sourceDateTime+" "+timeZone)
+	}
 	if err != nil {
-		log.Printf("ERROR: parsing acerTimeStamp %s: %s\n", acerDateTime, err)
+		log.Printf("ERROR: parsing sourceTimeStamp %s %s: %s\n", sourceDateTime, timeZone, err)
 		return nil, err
 	}
-	return &time, nil
+	return &t, nil
 }
 
-// Read the response from SyncApiEndpoint/SyncFolderId and return a corresponding SyncthingStatus
-// If an error occurs, it is logged here
-func GetSyncthingStatus() (*SyncthingStatus, error) {
-	endpoint := config.Get().SyncApiEndpoint + "?folder=" + config.Get().SyncFolderId
-	client := &http.Client{}
+var scrapeErrors int64 // Count of failed GetSyncthingStatus calls, since starting
+
+// Returns the number of failed calls to the syncthing api, since starting.
+func ScrapeErrors() int64 {
+	return atomic.LoadInt64(&scrapeErrors)
+}
+
+// Read the response from SyncApiEndpoint for the folderId and return a corresponding SyncthingStatus
+// If an error occurs, it is logged and counted here
+func GetSyncthingStatus(folderId string) (*SyncthingStatus, error) {
+	syncthingStatus, err := getSyncthingStatus(folderId)
+	if err != nil {
+		atomic.AddInt64(&scrapeErrors, 1)
+	}
+	return syncthingStatus, err
+}
+
+func getSyncthingStatus(folderId string) (*SyncthingStatus, error) {
+	endpoint := config.Get().SyncApiEndpoint + "?folder=" + url.QueryEscape(folderId)
+	client := &http.Client{Timeout: SYNC_API_TIMEOUT} // A hung syncthing mustn't hold up Refresh
 	request, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		log.Printf("ERROR: SyncthingStatus http.NewRequest: %s\n", err)
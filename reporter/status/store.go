@@ -0,0 +1,276 @@
+package status
+
+// The history records are kept in a HistoryStore, either a bolt database (the default) or
+// the original json lines HistoryFile. Records are ordered by their ServerTime, and old
+// records are thinned out by the retention policy (see applyRetention).
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"reporter/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STORE_BOLT = "bolt" // A bolt database at HistoryDbPath
+	STORE_JSON = "json" // Json lines in the HistoryFile
+
+	PRUNE_PERIOD = time.Hour // How often the retention policy is applied, when records are added
+)
+
+type HistoryStore interface {
+	// Adds the record.
+	Append(record BackupStatus) error
+	// Returns the records with a ServerTime from (inclusive) to (exclusive), oldest first.
+	// A zero from or to is unbounded.
+	Query(from, to time.Time) ([]BackupStatus, error)
+	// Removes the records with a ServerTime before the time, for which keep returns false.
+	// Returns the number removed.
+	Prune(before time.Time, keep func(record BackupStatus) bool) (int, error)
+	Close() error
+}
+
+var store HistoryStore
+var storeKey string // The type and path of the open store
+var storeMutex = &sync.Mutex{}
+var lastPrune time.Time
+
+// Returns the store for the current config, (re)opening it if the config has changed.
+// Must be called with the storeMutex held.
+func getStore() (HistoryStore, error) {
+	c := config.Get()
+	storeType := c.HistoryStore
+	if storeType == "" {
+		storeType = STORE_BOLT
+	}
+	path := c.HistoryFile
+	if storeType == STORE_BOLT {
+		path = HistoryDbPath(c)
+	}
+	key := storeType + ":" + path
+	if store != nil && key == storeKey {
+		return store, nil
+	}
+	if store != nil {
+		store.Close()
+		store = nil
+	}
+	var err error
+	switch storeType {
+	case STORE_BOLT:
+		store, err = openBoltStore(path, c.HistoryFile)
+	case STORE_JSON:
+		store = &jsonStore{path: path}
+	default:
+		err = errors.New("unknown HistoryStore '" + storeType + "' (bolt or json)")
+	}
+	if err != nil {
+		log.Printf("ERROR: opening history store %s: %s\n", key, err)
+		return nil, err
+	}
+	storeKey = key
+	log.Printf("history store: opened %s\n", key)
+	return store, nil
+}
+
+// Returns the path of the history database; by default the HistoryFile with a .db extension.
+func HistoryDbPath(c config.Configuration) string {
+	if c.HistoryDbPath != "" {
+		return c.HistoryDbPath
+	}
+	if c.HistoryFile == "" {
+		return "history.db"
+	}
+	return strings.TrimSuffix(c.HistoryFile, filepath.Ext(c.HistoryFile)) + ".db"
+}
+
+// Returns the history records with a ServerTime in the range (see HistoryStore.Query).
+func QueryHistory(from, to time.Time) ([]BackupStatus, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	s, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.Query(from, to)
+}
+
+// Adds the record to the history, and occasionally applies the retention policy.
+func SaveStatusToHistory(record BackupStatus) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	s, err := getStore()
+	if err != nil {
+		return err
+	}
+	if err = s.Append(record); err != nil {
+		log.Printf("ERROR: SaveStatusToHistory: %s\n", err)
+		return err
+	}
+	if time.Since(lastPrune) > PRUNE_PERIOD {
+		lastPrune = time.Now()
+		applyRetention(s, config.Get(), lastPrune)
+	}
+	return nil
+}
+
+// Every record is kept for HistoryKeepAllDays, after which only the last record of each
+// day (for each source) is kept, until HistoryKeepDays when they are all removed.
+// A zero HistoryKeepAllDays keeps every record, and a zero HistoryKeepDays keeps them forever.
+func applyRetention(s HistoryStore, c config.Configuration, now time.Time) {
+	var removeBefore, thinBefore time.Time
+	if c.HistoryKeepDays > 0 {
+		removeBefore = now.AddDate(0, 0, -c.HistoryKeepDays)
+	}
+	if c.HistoryKeepAllDays > 0 {
+		thinBefore = now.AddDate(0, 0, -c.HistoryKeepAllDays)
+	}
+	if thinBefore.IsZero() && removeBefore.IsZero() {
+		return
+	}
+	before := thinBefore
+	if before.IsZero() || (!removeBefore.IsZero() && removeBefore.After(before)) {
+		before = removeBefore
+	}
+	// Find the last record of each day for each source, amongst those that may be thinned.
+	lastOfDay := map[string]string{}
+	if !thinBefore.IsZero() {
+		records, err := s.Query(time.Time{}, thinBefore)
+		if err != nil {
+			log.Printf("ERROR: history retention: %s\n", err)
+			return
+		}
+		for _, r := range records {
+			lastOfDay[r.Source+"/"+recordTime(r).Format("2006-01-02")] = r.ServerTime
+		}
+	}
+	removed, err := s.Prune(before, func(r BackupStatus) bool {
+		t := recordTime(r)
+		if !removeBefore.IsZero() && t.Before(removeBefore) {
+			return false
+		}
+		if !thinBefore.IsZero() && t.Before(thinBefore) {
+			return lastOfDay[r.Source+"/"+t.Format("2006-01-02")] == r.ServerTime
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("ERROR: history retention: %s\n", err)
+	} else if removed > 0 {
+		log.Printf("history retention: removed %d records\n", removed)
+	}
+}
+
+// Returns the ServerTime of the record, or the zero time if it can't be parsed.
+func recordTime(r BackupStatus) time.Time {
+	t, err := time.ParseInLocation(REPORT_TIME_FORMAT, r.ServerTime, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// The original store; json lines appended to a file.
+type jsonStore struct {
+	path string
+}
+
+func (s *jsonStore) Append(record BackupStatus) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(line); err != nil {
+		return err
+	}
+	// A crash may still leave a partial last line, which readHistoryFile skips.
+	return file.Sync()
+}
+
+// Bad lines are logged and skipped. The records are in the order written, which is also
+// their time order.
+func (s *jsonStore) Query(from, to time.Time) ([]BackupStatus, error) {
+	records, err := readHistoryFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var selected []BackupStatus
+	for _, r := range records {
+		if inRange(recordTime(r), from, to) {
+			selected = append(selected, r)
+		}
+	}
+	return selected, nil
+}
+
+// The file is rewritten (atomically) without the removed records.
+func (s *jsonStore) Prune(before time.Time, keep func(record BackupStatus) bool) (int, error) {
+	records, err := readHistoryFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+	var content []byte
+	removed := 0
+	for _, r := range records {
+		if recordTime(r).Before(before) && !keep(r) {
+			removed++
+			continue
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, config.WriteFileAtomic(s.path, content, 0644)
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+// Reads all the records of a json lines history file, converting older records.
+// Lines that can't be parsed are logged and skipped.
+func readHistoryFile(path string) ([]BackupStatus, error) {
+	c := config.Get()
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("ERROR: opening for read %s: %s\n", path, err)
+		return nil, err
+	}
+	defer file.Close()
+	var history []BackupStatus
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		record := legacyBackupStatus{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			log.Printf("ERROR: skipping history record %s: %s\n", line, err)
+			continue
+		}
+		history = append(history, convertLegacy(c, record))
+	}
+	return history, scanner.Err()
+}
@@ -0,0 +1,140 @@
+package status
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reporter/config"
+	"testing"
+	"time"
+)
+
+// Uses a config in a new directory, with one source (Acer) for its one folder.
+func useTempConfig(t *testing.T) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	content := fmt.Sprintf(`{"ConfigVersion": %d, "Port": "8090",
+		"SyncApiEndpoint": "http://localhost:8384/rest/db/status",
+		"SyncFolders": [{"Id": "f1"}],
+		"Sources": [{"Name": "Acer", "FolderId": "f1", "StatusFilePath": %q}]}`,
+		config.CONFIG_VERSION, filepath.Join(dir, "status.txt"))
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Path(path)
+	return dir
+}
+
+func TestRetention(t *testing.T) {
+	dir := useTempConfig(t)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	at := func(days, hour int) string {
+		return now.AddDate(0, 0, -days).Add(time.Duration(hour-12) * time.Hour).Format(REPORT_TIME_FORMAT)
+	}
+	var records []BackupStatus
+	for _, source := range []string{"Acer", "Mac"} {
+		for _, days := range []int{12, 5, 1} {
+			for _, hour := range []int{9, 18} {
+				records = append(records, BackupStatus{Source: source, ServerTime: at(days, hour)})
+			}
+		}
+	}
+	tests := []struct {
+		keepDays    int
+		keepAllDays int
+		want        []string // The ServerTimes kept (of each source)
+	}{
+		{0, 0, []string{at(12, 9), at(12, 18), at(5, 9), at(5, 18), at(1, 9), at(1, 18)}},
+		{10, 0, []string{at(5, 9), at(5, 18), at(1, 9), at(1, 18)}},
+		{0, 2, []string{at(12, 18), at(5, 18), at(1, 9), at(1, 18)}},
+		{10, 2, []string{at(5, 18), at(1, 9), at(1, 18)}},
+		{3, 10, []string{at(1, 9), at(1, 18)}}, // Removed before thinned
+	}
+	for _, storeType := range []string{STORE_JSON, STORE_BOLT} {
+		for i, test := range tests {
+			var s HistoryStore
+			path := filepath.Join(dir, fmt.Sprintf("history-%d.%s", i, storeType))
+			if storeType == STORE_BOLT {
+				bolt, err := openBoltStore(path, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				s = bolt
+			} else {
+				s = &jsonStore{path: path}
+			}
+			for _, r := range records {
+				if err := s.Append(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := config.Configuration{HistoryKeepDays: test.keepDays, HistoryKeepAllDays: test.keepAllDays}
+			applyRetention(s, c, now)
+			kept, err := s.Query(time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, source := range []string{"Acer", "Mac"} {
+				for _, serverTime := range test.want {
+					want = append(want, source+" "+serverTime)
+				}
+			}
+			var got []string
+			for _, source := range []string{"Acer", "Mac"} {
+				for _, r := range kept {
+					if r.Source == source {
+						got = append(got, r.Source+" "+r.ServerTime)
+					}
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s keep %d, all %d: kept %v\nexpected %v", storeType, test.keepDays, test.keepAllDays, got, want)
+			}
+			s.Close()
+		}
+	}
+}
+
+// A history file is imported into a new database once, attributing the older records
+// to the configured source.
+func TestImportHistoryFile(t *testing.T) {
+	dir := useTempConfig(t)
+	historyFile := filepath.Join(dir, "history.json")
+	content := `{"ServerTime": "2019-02-12 21:50:00", "AcerFiles": 10, "AcerAge": "3h0m"}
+not json
+{"Source": "Mac", "FolderId": "f1", "ServerTime": "2019-02-12 21:55:00", "SourceFiles": 20}
+`
+	if err := ioutil.WriteFile(historyFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "history.db")
+	s, err := openBoltStore(dbPath, historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.Query(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BackupStatus{
+		{Source: "Acer", FolderId: "f1", ServerTime: "2019-02-12 21:50:00", SourceFiles: 10, SourceAge: "3h0m"},
+		{Source: "Mac", FolderId: "f1", ServerTime: "2019-02-12 21:55:00", SourceFiles: 20},
+	}
+	if fmt.Sprintf("%+v", records) != fmt.Sprintf("%+v", want) {
+		t.Errorf("imported %+v\nexpected %+v", records, want)
+	}
+	s.Close()
+
+	// Not imported again, even once the file has grown.
+	if err := ioutil.WriteFile(historyFile, []byte(content+content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openBoltStore(dbPath, historyFile); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if records, _ = s.Query(time.Time{}, time.Time{}); len(records) != 2 {
+		t.Errorf("reopened: %d records, expected 2", len(records))
+	}
+}